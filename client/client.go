@@ -3,20 +3,87 @@ package client
 import (
 	"errors"
 	"fmt"
+	"github.com/whyrusleeping/go-tftp/internal/rtt"
+	"github.com/whyrusleeping/go-tftp/internal/size"
 	pkt "github.com/whyrusleeping/go-tftp/packet"
 	"io"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 var ErrTimeout = errors.New("timeout")
 
+// maxStale bounds the number of server ports remembered as stale
+const maxStale = 1024
+
+// DefaultRetries is how often a packet is retransmitted without reply
+// before giving up with ErrTimeout, when the client has no Retries set
+const DefaultRetries = 5
+
+// errUnknownTID is sent in reply to packets from anyone but the server
+// port of a transfer
+var errUnknownTID = &pkt.ErrorPacket{Code: pkt.TFTPErrUnknownTID, Value: "unknown transfer ID"}
+
+// DefaultTimeout is how long to wait for a reply before retransmitting
+// when the client has no Timeout set, until the round trip time to the
+// server is measured
+const DefaultTimeout = time.Second
+
+// DefaultMinTimeout and DefaultMaxTimeout bound the retransmit timeout
+// when the client has no MinTimeout or MaxTimeout set
+const (
+	DefaultMinTimeout = time.Millisecond * 50
+	DefaultMaxTimeout = time.Second * 8
+)
+
 type TftpClient struct {
-	servaddr  *net.UDPAddr
-	udpconn   *net.UDPConn
-	packets   chan *packetReceipt
-	kill      chan struct{}
+	servaddr *net.UDPAddr
+	conn     net.PacketConn
+	packets  chan *packetReceipt
+	kill     chan struct{}
+	// closeOnce makes Close safe to call more than once
+	closeOnce sync.Once
+	// stale holds the server ports of earlier transfers, whose late
+	// packets must not be mistaken for replies to a new request
+	stale     map[string]struct{}
 	Blocksize int
+
+	// TransferSize is the size of the file being transferred, as
+	// announced in the servers OACK for GetFile or computed from the
+	// reader for PutFile. It is -1 when the size is unknown.
+	TransferSize int64
+
+	// Mode is the transfer mode to request, pkt.ModeOctet or
+	// pkt.ModeNetascii. Empty selects octet.
+	Mode string
+
+	// WindowSize is the number of blocks to ask the server to send, or
+	// to send to it, before waiting for an ACK (rfc 7440). Values below
+	// two keep the lock-step exchange of rfc 1350.
+	WindowSize int
+
+	// Rollover is the block number that follows 65535, either 0 or 1.
+	// It is sent as the rollover option when set to 1.
+	Rollover uint16
+
+	// Timeout is the retransmit timeout to use, and to ask the server
+	// to use with the timeout or utimeout option. Zero selects
+	// DefaultTimeout without negotiating it, and lets the timeout
+	// follow the round trip time measured to the server.
+	Timeout time.Duration
+
+	// MinTimeout and MaxTimeout bound the retransmit timeout, which
+	// doubles with every retransmit of the same packet. A Timeout that
+	// is set is never undercut.
+	MinTimeout time.Duration
+	MaxTimeout time.Duration
+
+	// Retries is how often a packet is retransmitted without reply
+	// before giving up with ErrTimeout. Zero selects DefaultRetries.
+	Retries int
 }
 
 func NewTftpClient(addr string) (*TftpClient, error) {
@@ -25,22 +92,35 @@ func NewTftpClient(addr string) (*TftpClient, error) {
 		return nil, err
 	}
 
-	raddr, err := net.ResolveUDPAddr("udp", addr)
+	uconn, err := net.ListenUDP("udp", laddr)
 	if err != nil {
 		return nil, err
 	}
 
-	uconn, err := net.ListenUDP("udp", laddr)
+	cli, err := NewTftpClientConn(uconn, addr)
+	if err != nil {
+		uconn.Close()
+		return nil, err
+	}
+	return cli, nil
+}
+
+// NewTftpClientConn returns a client for the server at addr which sends
+// and receives packets through conn, such as a wrapper simulating an
+// unreliable network. conn is closed by Close.
+func NewTftpClientConn(conn net.PacketConn, addr string) (*TftpClient, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
 		return nil, err
 	}
 
 	cli := &TftpClient{
-		servaddr:  raddr,
-		udpconn:   uconn,
-		Blocksize: 512,
-		packets:   make(chan *packetReceipt),
-		kill:      make(chan struct{}),
+		servaddr:     raddr,
+		conn:         conn,
+		Blocksize:    512,
+		TransferSize: -1,
+		packets:      make(chan *packetReceipt),
+		kill:         make(chan struct{}),
 	}
 
 	go cli.recvLoop()
@@ -50,30 +130,38 @@ func NewTftpClient(addr string) (*TftpClient, error) {
 
 type packetReceipt struct {
 	Packet pkt.Packet
-	Addr   *net.UDPAddr
+	Addr   net.Addr
 	Err    error
 }
 
 func (cl *TftpClient) recvLoop() {
 	buf := make([]byte, 32768*2)
 	for {
-		pkt, addr, err := cl.recvPacket(buf)
+		p, addr, err := cl.recvPacket(buf)
+		if errors.Is(err, pkt.ErrInvalidPacket) {
+			fmt.Printf("Dropping bad packet: %s\n", err)
+			continue
+		}
 		select {
-		case cl.packets <- &packetReceipt{pkt, addr, err}:
+		case cl.packets <- &packetReceipt{p, addr, err}:
 		case <-cl.kill:
 			return
 		}
 	}
 }
 
+// Close closes the connection of the client. It may be called more
+// than once.
 func (cl *TftpClient) Close() {
-	cl.udpconn.Close()
-	cl.kill <- struct{}{}
+	cl.closeOnce.Do(func() {
+		cl.conn.Close()
+		close(cl.kill)
+	})
 }
 
-func (cl *TftpClient) sendPacket(p pkt.Packet, addr *net.UDPAddr) error {
+func (cl *TftpClient) sendPacket(p pkt.Packet, addr net.Addr) error {
 	data := p.Bytes()
-	n, err := cl.udpconn.WriteToUDP(p.Bytes(), addr)
+	n, err := cl.conn.WriteTo(p.Bytes(), addr)
 	if err != nil {
 		fmt.Printf("Write UDP error: %s\n", err)
 		fmt.Printf("attempted to write %d bytes to '%s'\n", len(p.Bytes()), addr)
@@ -89,8 +177,8 @@ func (cl *TftpClient) sendPacket(p pkt.Packet, addr *net.UDPAddr) error {
 	return nil
 }
 
-func (cl *TftpClient) recvPacket(buf []byte) (pkt.Packet, *net.UDPAddr, error) {
-	n, addr, err := cl.udpconn.ReadFromUDP(buf)
+func (cl *TftpClient) recvPacket(buf []byte) (pkt.Packet, net.Addr, error) {
+	n, addr, err := cl.conn.ReadFrom(buf)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -100,7 +188,9 @@ func (cl *TftpClient) recvPacket(buf []byte) (pkt.Packet, *net.UDPAddr, error) {
 	}
 	buf = buf[:n]
 
-	pkt, err := pkt.ParsePacket(buf)
+	// Copy the packet out, buf is reused for the next one while
+	// this one is still being handled
+	pkt, err := pkt.ParsePacket(append([]byte(nil), buf...))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -108,97 +198,229 @@ func (cl *TftpClient) recvPacket(buf []byte) (pkt.Packet, *net.UDPAddr, error) {
 	return pkt, addr, nil
 }
 
+// retransmit is the retransmit state of a transfer, kept as the server
+// keeps it: the packets last sent are retransmitted each time the
+// deadline passes without an answer, until the transfer is given up
+// after Retries retransmits. Only packets that advance the transfer
+// restart the wait, so stray packets cannot hold off the timeout.
+type retransmit struct {
+	rtt      *rtt.Estimator
+	deadline time.Time
+	retries  int
+}
+
+// sent starts the wait for an answer to packets just sent
+func (r *retransmit) sent() {
+	r.rtt.Sent()
+	r.progress()
+}
+
+// progress restarts the wait as the server is making progress
+func (r *retransmit) progress() {
+	r.retries = 0
+	r.deadline = time.Now().Add(r.rtt.RTO())
+}
+
+// answered tells r that the server answered the packets last sent,
+// timing the round trip
+func (r *retransmit) answered() {
+	r.rtt.Answered()
+}
+
+// waitPacket waits for the next packet from the server, calling resend
+// each time the deadline of r passes without one arriving. It returns
+// ErrTimeout when the deadline passes once more after the last of the
+// retransmits.
+func (cl *TftpClient) waitPacket(r *retransmit, resend func() error) (*packetReceipt, error) {
+	for {
+		timer := time.NewTimer(time.Until(r.deadline))
+		select {
+		case recv := <-cl.packets:
+			timer.Stop()
+			if recv.Err != nil {
+				return nil, recv.Err
+			}
+			return recv, nil
+		case <-timer.C:
+			if r.retries >= cl.retries() {
+				return nil, ErrTimeout
+			}
+			r.retries++
+			r.rtt.Retransmitted()
+			err := resend()
+			if err != nil {
+				return nil, err
+			}
+			r.deadline = time.Now().Add(r.rtt.RTO())
+		}
+	}
+}
+
+func (cl *TftpClient) retries() int {
+	if cl.Retries > 0 {
+		return cl.Retries
+	}
+	return DefaultRetries
+}
+
 func (cl *TftpClient) PutFile(filename string, data io.Reader) (int, error) {
 	req := &pkt.ReqPacket{
 		Filename:  filename,
-		Mode:      "octet",
+		Mode:      cl.mode(),
 		Type:      pkt.WRQ,
 		BlockSize: cl.Blocksize,
 	}
+	cl.setTimeoutOption(req)
+	cl.setWindowOptions(req)
+	rt := &retransmit{rtt: cl.newEstimator()}
+	cl.TransferSize = size.Of(data)
+	if strings.EqualFold(req.Mode, pkt.ModeNetascii) {
+		// The size on the wire is not known until the data is encoded
+		data = pkt.NewNetasciiReader(data)
+		cl.TransferSize = -1
+	}
+	if cl.TransferSize >= 0 {
+		req.Options.Set(pkt.OptTransferSize, fmt.Sprint(cl.TransferSize))
+	}
 
 	err := cl.sendPacket(req, cl.servaddr)
 	if err != nil {
 		return 0, err
 	}
-
-	blknum := uint16(0)
-	xferred := 0
-	quit := false
-	buf := make([]byte, cl.Blocksize)
-	var lastPacket pkt.Packet = req
-	var addr *net.UDPAddr
-	for {
-		var recv *packetReceipt
-
-		success := false
-		for !success {
-			select {
-			case recv = <-cl.packets:
-				success = true
-				addr = recv.Addr
-			case <-time.After(time.Second * 5):
-				fmt.Println("Receive timeout!")
-				var err error
-				if addr == nil {
-					err = cl.sendPacket(lastPacket, cl.servaddr)
-				} else {
-					err = cl.sendPacket(lastPacket, addr)
-				}
-				if err != nil {
-					return 0, err
-				}
-			}
+	rt.sent()
+
+	// Wait for the server to accept the request with ACK(0) or an OACK
+	blksize := 512
+	windowsize := 1
+	rollover := uint16(0)
+	var addr net.Addr
+	for addr == nil {
+		recv, err := cl.waitPacket(rt, func() error {
+			fmt.Println("Receive timeout!")
+			return cl.sendPacket(req, cl.servaddr)
+		})
+		if err != nil {
+			return 0, err
 		}
-		if recv.Err != nil {
-			return 0, recv.Err
+		if cl.isStale(recv.Addr) || !cl.fromServer(recv.Addr) {
+			// Left over from an earlier transfer, or not from
+			// the server at all
+			cl.refuse(recv)
+			continue
 		}
 
 		switch p := recv.Packet.(type) {
 		case *pkt.ErrorPacket:
-			fmt.Println("Error packet.")
+			if p.Code == pkt.TFTPErrUnknownTID {
+				// A reply to a late packet of an earlier
+				// transfer, never to a request
+				continue
+			}
 			return 0, p
 		case *pkt.AckPacket:
-			if p.GetBlocknum() != blknum {
-				fmt.Printf("Wrong blocknumber! (%d != %d)\n", p.GetBlocknum(), blknum)
+			if p.GetBlocknum() != 0 {
+				// Likely left over from an earlier transfer
+				fmt.Printf("Wrong blocknumber! (%d != 0)\n", p.GetBlocknum())
 				continue
 			}
-			if blknum == 0 && cl.Blocksize != 512 {
+			if cl.Blocksize != 512 {
 				fmt.Println("Didnt get expected OACK.")
 			}
 		case *pkt.OAckPacket:
-			if blknum != 0 {
-				return 0, errors.New("Received OACK at unexpected time...")
-			}
-			if p.Options["blksize"] != fmt.Sprint(cl.Blocksize) {
-				fmt.Printf("Blocksize Negotiation failed!\ngot '%s'\n", p.Options["blocksize"])
+			blksize, windowsize, rollover, err = cl.oackOptions(p, recv.Addr)
+			if err != nil {
+				return 0, err
 			}
 		default:
-			return 0, fmt.Errorf("unexpected packet: %v, %d", p, p.GetType())
-		}
-		if quit {
-			break
+			// Left over from an earlier transfer
+			continue
 		}
-		blknum++
-		buf = buf[:cl.Blocksize]
-		n, err := data.Read(buf)
-		if err != nil && err != io.EOF {
-			return 0, err
+		rt.answered()
+		addr = recv.Addr
+	}
+	defer cl.markStale(addr)
+
+	// window holds the blocks sent but not yet acknowledged, it is
+	// refilled up to windowsize blocks before each send
+	var window []*pkt.DataPacket
+	sendWindow := func() error {
+		for _, d := range window {
+			err := cl.sendPacket(d, addr)
+			if err != nil {
+				return err
+			}
 		}
-		buf = buf[:n]
-		xferred += n
+		return nil
+	}
 
-		datapkt := &pkt.DataPacket{
-			BlockNum: blknum,
-			Data:     buf,
+	xferred := 0
+	blknum := uint16(1)
+	done := false
+	for !done || len(window) > 0 {
+		for !done && len(window) < windowsize {
+			buf := make([]byte, blksize)
+			n, err := io.ReadFull(data, buf)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return 0, err
+			}
+			xferred += n
+			if n < blksize {
+				done = true
+			}
+			window = append(window, &pkt.DataPacket{
+				BlockNum: blknum,
+				Data:     buf[:n],
+			})
+			blknum = pkt.NextBlockNum(blknum, rollover)
 		}
-		lastPacket = datapkt
-		err = cl.sendPacket(datapkt, addr)
+
+		err := sendWindow()
 		if err != nil {
 			return 0, err
 		}
-		if n < cl.Blocksize {
-			quit = true
+		rt.sent()
+
+		// Wait for an ACK of any block in the window. rfc 7440: the
+		// next window starts right after the acknowledged block.
+		acked := 0
+		for acked == 0 {
+			recv, err := cl.waitPacket(rt, sendWindow)
+			if err != nil {
+				return 0, err
+			}
+			if !sameAddr(recv.Addr, addr) {
+				// Another transfer, started by a retransmit of
+				// our request, or someone else entirely
+				cl.markStale(recv.Addr)
+				cl.refuse(recv)
+				continue
+			}
+
+			switch p := recv.Packet.(type) {
+			case *pkt.ErrorPacket:
+				if cl.lateRefusal(p, addr) {
+					continue
+				}
+				fmt.Println("Error packet.")
+				return 0, p
+			case *pkt.AckPacket:
+				for i, d := range window {
+					if d.BlockNum == p.GetBlocknum() {
+						acked = i + 1
+						rt.answered()
+						break
+					}
+				}
+				// Otherwise it is a stale ACK from before this window
+			case *pkt.OAckPacket:
+				// A retransmitted OACK, the window is resent
+				// if this means it was lost
+				continue
+			default:
+				return 0, fmt.Errorf("unexpected packet: %v, %d", p, p.GetType())
+			}
 		}
+		window = window[acked:]
 	}
 
 	return xferred, nil
@@ -207,55 +429,112 @@ func (cl *TftpClient) PutFile(filename string, data io.Reader) (int, error) {
 func (cl *TftpClient) GetFile(filename string, out io.Writer) (int, error) {
 	req := &pkt.ReqPacket{
 		Filename:  filename,
-		Mode:      "octet",
+		Mode:      cl.mode(),
 		Type:      pkt.RRQ,
 		BlockSize: cl.Blocksize,
 	}
+	var nw *pkt.NetasciiWriter
+	if out != nil && strings.EqualFold(req.Mode, pkt.ModeNetascii) {
+		nw = pkt.NewNetasciiWriter(out)
+		out = nw
+	}
+	// Ask the server to tell us the size of the file
+	req.Options.Set(pkt.OptTransferSize, "0")
+	cl.setTimeoutOption(req)
+	cl.setWindowOptions(req)
+	rt := &retransmit{rtt: cl.newEstimator()}
+	cl.TransferSize = -1
 
 	err := cl.sendPacket(req, cl.servaddr)
 	if err != nil {
 		return 0, err
 	}
+	rt.sent()
 
 	xfersize := 0
 	blknum := uint16(1)
+	// prevblk is the last block received in order
+	prevblk := uint16(0)
+	started := false
+	blksize := 512
+	windowsize := 1
+	rollover := uint16(0)
+	// inwindow counts the blocks received since our last ACK
+	inwindow := 0
 	var lastPacket pkt.Packet = req
-	var addr *net.UDPAddr
+	var addr net.Addr
+	defer func() {
+		if addr != nil {
+			cl.markStale(addr)
+		}
+	}()
 	for {
-		var recv *packetReceipt
-		success := false
-		for !success {
-			select {
-			case recv = <-cl.packets:
-				addr = recv.Addr
-				success = true
-			case <-time.After(time.Second * 5):
-				var err error
-				if addr == nil {
-					err = cl.sendPacket(lastPacket, cl.servaddr)
-				} else {
-					err = cl.sendPacket(lastPacket, addr)
-				}
-				if err != nil {
-					return 0, err
-				}
+		recv, err := cl.waitPacket(rt, func() error {
+			if addr == nil {
+				return cl.sendPacket(lastPacket, cl.servaddr)
 			}
-		}
-
+			return cl.sendPacket(lastPacket, addr)
+		})
 		if err != nil {
 			return 0, err
 		}
+		if addr == nil {
+			// The first reply picks the server port of the transfer,
+			// anything else is left over from an earlier transfer
+			// or comes from someone other than the server
+			if cl.isStale(recv.Addr) || !cl.fromServer(recv.Addr) {
+				cl.refuse(recv)
+				continue
+			}
+			if d, ok := recv.Packet.(*pkt.DataPacket); ok && d.BlockNum != 1 {
+				cl.refuse(recv)
+				continue
+			}
+			if _, ok := recv.Packet.(*pkt.AckPacket); ok {
+				cl.refuse(recv)
+				continue
+			}
+			if e, ok := recv.Packet.(*pkt.ErrorPacket); ok && e.Code == pkt.TFTPErrUnknownTID {
+				// A reply to a late packet of an earlier
+				// transfer, never to a request
+				continue
+			}
+			addr = recv.Addr
+		} else if !sameAddr(recv.Addr, addr) {
+			// The transfer is locked to the port of the first
+			// reply, no one else gets to send us data
+			cl.markStale(recv.Addr)
+			cl.refuse(recv)
+			continue
+		}
 
 		var data []byte
 		switch recv.Packet.GetType() {
 		case pkt.ERROR:
+			if cl.lateRefusal(recv.Packet.(*pkt.ErrorPacket), addr) {
+				continue
+			}
 			return 0, recv.Packet.(*pkt.ErrorPacket)
 		case pkt.DATA:
 			datapkt := recv.Packet.(*pkt.DataPacket)
 			if datapkt.BlockNum != blknum {
-				return 0, fmt.Errorf("Got wrong numbered data packet! (%d != %d)", datapkt.BlockNum, blknum)
+				// A gap or a duplicate, rfc 7440 says to acknowledge
+				// the last block received in order so the server
+				// restarts its window from there
+				ack := pkt.NewAck(prevblk)
+				err = cl.sendPacket(ack, addr)
+				if err != nil {
+					return 0, err
+				}
+				// It does not advance the transfer, so the wait
+				// for the missing block goes on
+				lastPacket = ack
+				inwindow = 0
+				continue
 			}
+			rt.answered()
 			data = datapkt.Data
+			started = true
 
 			// If we have an output writer, write the data out
 			if out != nil {
@@ -268,30 +547,222 @@ func (cl *TftpClient) GetFile(filename string, out io.Writer) (int, error) {
 				}
 			}
 		case pkt.OACK:
-			fmt.Println("GOT OACK!!!")
-			blknum--
+			if started {
+				// Our ACK of the OACK was lost, so it is sent again
+				continue
+			}
+			rt.answered()
 			oack := recv.Packet.(*pkt.OAckPacket)
-			if oack.Options["blksize"] != fmt.Sprint(cl.Blocksize) {
-				return 0, errors.New("failed to negotiate blocksize")
+			blksize, windowsize, rollover, err = cl.oackOptions(oack, addr)
+			if err != nil {
+				return 0, err
+			}
+			if v, ok := oack.Options.Get(pkt.OptTransferSize); ok {
+				ts, err := strconv.ParseInt(v, 10, 64)
+				if err == nil && ts >= 0 {
+					cl.TransferSize = ts
+				}
+			}
+			// Acknowledge the options with ACK(0), then wait for DATA(1)
+			err = cl.sendPacket(pkt.NewAck(0), addr)
+			if err != nil {
+				return 0, err
 			}
+			lastPacket = pkt.NewAck(0)
+			rt.sent()
+			continue
 		default:
-			fmt.Printf("Got: %d\n", recv.Packet.GetType())
-			fmt.Println(recv.Packet.(*pkt.AckPacket).GetBlocknum())
-			fmt.Println(blknum)
-			return 0, errors.New("Expected DATA packet!")
+			return 0, fmt.Errorf("unexpected packet: %v, %d", recv.Packet, recv.Packet.GetType())
 		}
 
-		ack := pkt.NewAck(blknum)
-		err = cl.sendPacket(ack, addr)
-		if err != nil {
-			return 0, err
+		xfersize += len(data)
+		inwindow++
+
+		// Only the last block of each window is acknowledged
+		last := len(data) < blksize
+		if last || inwindow == windowsize {
+			ack := pkt.NewAck(blknum)
+			err = cl.sendPacket(ack, addr)
+			if err != nil {
+				return 0, err
+			}
+			lastPacket = ack
+			rt.sent()
+			inwindow = 0
+		} else {
+			// The window is still coming in, a timeout now
+			// acknowledges what arrived of it
+			lastPacket = pkt.NewAck(blknum)
+			rt.progress()
 		}
 
-		xfersize += len(data)
-		if len(data) < cl.Blocksize {
+		if last {
 			break
 		}
-		blknum++
+		prevblk = blknum
+		blknum = pkt.NextBlockNum(blknum, rollover)
+	}
+	if nw != nil {
+		err = nw.Flush()
+		if err != nil {
+			return xfersize, err
+		}
 	}
 	return xfersize, nil
 }
+
+// markStale remembers addr as the server port of a finished transfer.
+// Servers in single port mode answer from the port requests are sent
+// to, which is never stale.
+func (cl *TftpClient) markStale(addr net.Addr) {
+	if sameAddr(addr, cl.servaddr) {
+		return
+	}
+	if cl.stale == nil || len(cl.stale) >= maxStale {
+		cl.stale = make(map[string]struct{})
+	}
+	cl.stale[addr.String()] = struct{}{}
+}
+
+// refuse answers a packet that is not part of the current transfer with
+// an unknown transfer ID error (rfc 1350). Errors are never answered,
+// and neither is the port requests are sent to, which is not the port
+// of a transfer unless the server runs all transfers on it.
+func (cl *TftpClient) refuse(recv *packetReceipt) {
+	if _, ok := recv.Packet.(*pkt.ErrorPacket); ok || sameAddr(recv.Addr, cl.servaddr) {
+		return
+	}
+	fmt.Printf("Packet from unknown transfer ID %s\n", recv.Addr)
+	cl.sendPacket(errUnknownTID, recv.Addr)
+}
+
+// lateRefusal reports whether e, received from the server port addr of
+// the transfer, may refuse a late packet of an earlier transfer. Servers
+// in single port mode run all transfers on the port requests are sent
+// to, so their unknown transfer ID errors cannot be told apart.
+func (cl *TftpClient) lateRefusal(e *pkt.ErrorPacket, addr net.Addr) bool {
+	return e.Code == pkt.TFTPErrUnknownTID && sameAddr(addr, cl.servaddr)
+}
+
+// fromServer reports whether addr is on the host of the server, the
+// only one that can answer a request
+func (cl *TftpClient) fromServer(addr net.Addr) bool {
+	if ua, ok := addr.(*net.UDPAddr); ok {
+		return ua.IP.Equal(cl.servaddr.IP)
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	return err == nil && net.ParseIP(host).Equal(cl.servaddr.IP)
+}
+
+func (cl *TftpClient) isStale(addr net.Addr) bool {
+	_, ok := cl.stale[addr.String()]
+	return ok
+}
+
+// sameAddr reports whether a and b are the same address
+func sameAddr(a, b net.Addr) bool {
+	return a.String() == b.String()
+}
+
+func (cl *TftpClient) mode() string {
+	if cl.Mode == "" {
+		return pkt.ModeOctet
+	}
+	return cl.Mode
+}
+
+// setTimeoutOption asks the server to use our Timeout, using whole
+// seconds when possible and utimeout otherwise
+func (cl *TftpClient) setTimeoutOption(req *pkt.ReqPacket) {
+	if cl.Timeout <= 0 {
+		return
+	}
+	if cl.Timeout%time.Second == 0 && cl.Timeout <= 255*time.Second {
+		req.Options.Set(pkt.OptTimeout, fmt.Sprint(int64(cl.Timeout/time.Second)))
+	} else {
+		req.Options.Set(pkt.OptUTimeout, fmt.Sprint(int64(cl.Timeout/time.Microsecond)))
+	}
+}
+
+// newEstimator returns the round trip time estimator of a transfer,
+// starting with our Timeout
+func (cl *TftpClient) newEstimator() *rtt.Estimator {
+	initial, min, max := DefaultTimeout, cl.MinTimeout, cl.MaxTimeout
+	if min <= 0 {
+		min = DefaultMinTimeout
+	}
+	if max <= 0 {
+		max = DefaultMaxTimeout
+	}
+	if cl.Timeout > 0 {
+		// The server was asked to use it, we do the same
+		initial, min = cl.Timeout, cl.Timeout
+	}
+	if max < initial {
+		max = initial
+	}
+	return rtt.New(initial, min, max)
+}
+
+// setWindowOptions asks the server for our WindowSize and Rollover
+func (cl *TftpClient) setWindowOptions(req *pkt.ReqPacket) {
+	if cl.WindowSize > 1 {
+		req.Options.Set(pkt.OptWindowSize, fmt.Sprint(cl.WindowSize))
+	}
+	if cl.Rollover != 0 {
+		req.Options.Set(pkt.OptRollover, fmt.Sprint(cl.Rollover))
+	}
+}
+
+// oackOptions returns the options the server at addr agreed to in its
+// OACK. A value we did not ask for is refused with an option negotiation
+// error (rfc 2347), ending the transfer.
+func (cl *TftpClient) oackOptions(oack *pkt.OAckPacket, addr net.Addr) (blksize, windowsize int, rollover uint16, err error) {
+	blksize, err = cl.oackBlocksize(oack)
+	if err == nil {
+		windowsize, err = cl.oackWindowsize(oack)
+	}
+	if err != nil {
+		refused := &pkt.ErrorPacket{Code: pkt.TFTPErrOptionRefused, Value: err.Error()}
+		cl.sendPacket(refused, addr)
+		return 0, 0, 0, fmt.Errorf("%w: %v", pkt.ErrOptionRefused, err)
+	}
+	return blksize, windowsize, oackRollover(oack), nil
+}
+
+// oackRollover returns the block number the server will wrap around
+// to, 0 unless it agreed to something else in its OACK
+func oackRollover(oack *pkt.OAckPacket) uint16 {
+	if v, _ := oack.Options.Get(pkt.OptRollover); v == "1" {
+		return 1
+	}
+	return 0
+}
+
+// oackWindowsize returns the window size the server agreed to in its
+// OACK, which may be smaller than the one we asked for
+func (cl *TftpClient) oackWindowsize(oack *pkt.OAckPacket) (int, error) {
+	v, ok := oack.Options.Get(pkt.OptWindowSize)
+	if !ok {
+		return 1, nil
+	}
+	ws, err := strconv.Atoi(v)
+	if err != nil || ws < 1 || ws > cl.WindowSize {
+		return 0, errors.New("failed to negotiate windowsize")
+	}
+	return ws, nil
+}
+
+// oackBlocksize returns the block size the server agreed to in its
+// OACK, which may be smaller than the one we asked for
+func (cl *TftpClient) oackBlocksize(oack *pkt.OAckPacket) (int, error) {
+	v, ok := oack.Options.Get(pkt.OptBlockSize)
+	if !ok {
+		return 512, nil
+	}
+	bs, err := strconv.Atoi(v)
+	if err != nil || bs < 8 || bs > cl.Blocksize {
+		return 0, errors.New("failed to negotiate blocksize")
+	}
+	return bs, nil
+}
@@ -0,0 +1,278 @@
+package client_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/whyrusleeping/go-tftp/client"
+	pkt "github.com/whyrusleeping/go-tftp/packet"
+)
+
+// listen opens a UDP socket standing in for a server or a stranger
+func listen(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func recv(t *testing.T, conn net.PacketConn) (pkt.Packet, net.Addr) {
+	t.Helper()
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := pkt.ParsePacket(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, from
+}
+
+func expectUnknownTID(t *testing.T, conn net.PacketConn) {
+	t.Helper()
+	p, _ := recv(t, conn)
+	if err, ok := p.(error); !ok || !errors.Is(err, pkt.ErrUnknownTID) {
+		t.Fatalf("expected unknown transfer ID error, got %v", p)
+	}
+}
+
+func TestUnknownTID(t *testing.T) {
+	listener := listen(t)
+	transfer := listen(t)
+	stranger := listen(t)
+	// Another host, as far as the client can tell
+	outsider, err := net.ListenPacket("udp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("no second loopback address: %v", err)
+	}
+	defer outsider.Close()
+
+	cli, err := client.NewTftpClient(listener.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	got := make(chan result, 1)
+	go func() {
+		out := new(bytes.Buffer)
+		_, err := cli.GetFile("file", out)
+		got <- result{out.Bytes(), err}
+	}()
+
+	// Only the host of the server can answer the request, whoever
+	// else replies first is refused
+	_, caddr := recv(t, listener)
+	outsider.WriteTo((&pkt.DataPacket{BlockNum: 1, Data: []byte("hijacked")}).Bytes(), caddr)
+	expectUnknownTID(t, outsider)
+
+	block := bytes.Repeat([]byte("a"), 512)
+	transfer.WriteTo((&pkt.DataPacket{BlockNum: 1, Data: block}).Bytes(), caddr)
+	if p, _ := recv(t, transfer); !bytes.Equal(p.Bytes(), pkt.NewAck(1).Bytes()) {
+		t.Fatalf("expected ACK(1), got %v", p)
+	}
+
+	// The transfer is locked to the port of the first reply, data and
+	// errors from anyone else are refused and ignored
+	stranger.WriteTo((&pkt.DataPacket{BlockNum: 2, Data: []byte("hijacked")}).Bytes(), caddr)
+	expectUnknownTID(t, stranger)
+	stranger.WriteTo((&pkt.ErrorPacket{Code: pkt.TFTPErrUndefined, Value: "abort"}).Bytes(), caddr)
+
+	transfer.WriteTo((&pkt.DataPacket{BlockNum: 2, Data: []byte("end")}).Bytes(), caddr)
+	if p, _ := recv(t, transfer); !bytes.Equal(p.Bytes(), pkt.NewAck(2).Bytes()) {
+		t.Fatalf("expected ACK(2), got %v", p)
+	}
+	res := <-got
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if want := append(block, "end"...); !bytes.Equal(res.data, want) {
+		t.Fatalf("got %d bytes, expected %d", len(res.data), len(want))
+	}
+}
+
+func TestLateUnknownTID(t *testing.T) {
+	// A server in single port mode refuses the late packets of an
+	// earlier transfer from the port the next request goes to
+	listener := listen(t)
+	cli, err := client.NewTftpClient(listener.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	refused := (&pkt.ErrorPacket{Code: pkt.TFTPErrUnknownTID, Value: "unknown transfer ID"}).Bytes()
+
+	got := make(chan error, 1)
+	go func() {
+		_, err := cli.GetFile("file", new(bytes.Buffer))
+		got <- err
+	}()
+	_, caddr := recv(t, listener)
+	listener.WriteTo(refused, caddr)
+	listener.WriteTo((&pkt.DataPacket{BlockNum: 1, Data: make([]byte, 512)}).Bytes(), caddr)
+	if p, _ := recv(t, listener); !bytes.Equal(p.Bytes(), pkt.NewAck(1).Bytes()) {
+		t.Fatalf("expected ACK(1), got %v", p)
+	}
+	// Also once the transfer runs on that port
+	listener.WriteTo(refused, caddr)
+	listener.WriteTo((&pkt.DataPacket{BlockNum: 2, Data: []byte("file")}).Bytes(), caddr)
+	if p, _ := recv(t, listener); !bytes.Equal(p.Bytes(), pkt.NewAck(2).Bytes()) {
+		t.Fatalf("expected ACK(2), got %v", p)
+	}
+	if err := <-got; err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		_, err := cli.PutFile("file", bytes.NewReader(nil))
+		got <- err
+	}()
+	recv(t, listener)
+	listener.WriteTo(refused, caddr)
+	listener.WriteTo(pkt.NewAck(0).Bytes(), caddr)
+	if p, _ := recv(t, listener); p.GetType() != pkt.DATA {
+		t.Fatalf("expected DATA(1), got %v", p)
+	}
+	listener.WriteTo(refused, caddr)
+	listener.WriteTo(pkt.NewAck(1).Bytes(), caddr)
+	if err := <-got; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNoisyStranger(t *testing.T) {
+	// Packets from a stranger do not advance the transfer, so they must
+	// not hold off the retransmits and the timeout
+	listener := listen(t)
+	transfer := listen(t)
+	stranger := listen(t)
+
+	cli, err := client.NewTftpClient(listener.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.Timeout = 20 * time.Millisecond
+	cli.Retries = 2
+
+	got := make(chan error, 1)
+	go func() {
+		_, err := cli.GetFile("file", new(bytes.Buffer))
+		got <- err
+	}()
+	_, caddr := recv(t, listener)
+	transfer.WriteTo((&pkt.DataPacket{BlockNum: 1, Data: make([]byte, 512)}).Bytes(), caddr)
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(5 * time.Second)
+	for err = nil; err == nil; {
+		select {
+		case err = <-got:
+			if !errors.Is(err, client.ErrTimeout) {
+				t.Fatalf("expected ErrTimeout, got %v", err)
+			}
+		case <-ticker.C:
+			stranger.WriteTo(pkt.NewAck(1).Bytes(), caddr)
+		case <-deadline:
+			t.Fatal("GetFile did not time out")
+		}
+	}
+
+	// ACK(1), then one retransmit of it for each retry
+	acks := 0
+	for {
+		buf := make([]byte, 1024)
+		transfer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		n, _, err := transfer.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		if !bytes.Equal(buf[:n], pkt.NewAck(1).Bytes()) {
+			t.Fatalf("expected ACK(1), got %v", buf[:n])
+		}
+		acks++
+	}
+	if acks != 1+cli.Retries {
+		t.Fatalf("got %d ACKs, expected %d", acks, 1+cli.Retries)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	listener := listen(t)
+	cli, err := client.NewTftpClient(listener.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cli.Close()
+		cli.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("second Close blocked")
+	}
+}
+
+func TestRefuseOption(t *testing.T) {
+	// An OACK with a value we did not ask for is refused with an option
+	// negotiation error, or the server would keep retransmitting it
+	tests := []struct {
+		name       string
+		opt, value string
+		transfer   func(*client.TftpClient) error
+	}{
+		{"blksize", pkt.OptBlockSize, "4096", func(cli *client.TftpClient) error {
+			_, err := cli.GetFile("file", new(bytes.Buffer))
+			return err
+		}},
+		{"windowsize", pkt.OptWindowSize, "8", func(cli *client.TftpClient) error {
+			_, err := cli.PutFile("file", bytes.NewReader([]byte("data")))
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener := listen(t)
+			transfer := listen(t)
+			cli, err := client.NewTftpClient(listener.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cli.Close()
+			cli.Blocksize = 1024
+			cli.WindowSize = 4
+
+			got := make(chan error, 1)
+			go func() { got <- tt.transfer(cli) }()
+			_, caddr := recv(t, listener)
+			oack := pkt.NewOAckPacket()
+			oack.Options.Set(tt.opt, tt.value)
+			transfer.WriteTo(oack.Bytes(), caddr)
+
+			p, _ := recv(t, transfer)
+			if err, ok := p.(error); !ok || !errors.Is(err, pkt.ErrOptionRefused) {
+				t.Fatalf("expected option refused error, got %v", p)
+			}
+			if err := <-got; !errors.Is(err, pkt.ErrOptionRefused) {
+				t.Fatalf("expected ErrOptionRefused, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+// Package rtt estimates the round trip time of a transfer to set its
+// retransmit timeout, following rfc 6298.
+package rtt
+
+import "time"
+
+// Estimator tracks the smoothed round trip time and its variance for one
+// transfer. The round trip is timed from Sent to Answered, and by Karn's
+// rule not at all when the packet had to be retransmitted, as there is
+// no telling which transmission was answered.
+//
+// The retransmit timeout doubles with every retransmit of a packet, and
+// each new packet starts over from the estimate. Keeping the backed off
+// timeout until the next sample, as rfc 6298 does, stalls lock-step
+// transfers on lossy links, where every exchange is a new packet.
+type Estimator struct {
+	min, max time.Duration
+
+	srtt   time.Duration
+	rttvar time.Duration
+	// base is the timeout from the estimate, rto the backed off one
+	base time.Duration
+	rto  time.Duration
+
+	// sent is when the packet awaiting an answer was sent, zero if
+	// there is none to time
+	sent time.Time
+}
+
+// New returns an Estimator with the retransmit timeout initial, which is
+// kept between min and max.
+func New(initial, min, max time.Duration) *Estimator {
+	e := &Estimator{min: min, max: max}
+	e.base = e.clamp(initial)
+	e.rto = e.base
+	return e
+}
+
+// RTO returns the retransmit timeout.
+func (e *Estimator) RTO() time.Duration {
+	return e.rto
+}
+
+// SRTT returns the smoothed round trip time, zero until it is measured.
+func (e *Estimator) SRTT() time.Duration {
+	return e.srtt
+}
+
+// Sent marks a new packet sent, to be timed until it is answered.
+func (e *Estimator) Sent() {
+	e.sent = time.Now()
+	e.rto = e.base
+}
+
+// Retransmitted doubles the retransmit timeout after a packet had to be
+// sent again, and stops timing it.
+func (e *Estimator) Retransmitted() {
+	e.sent = time.Time{}
+	e.rto = e.clamp(2 * e.rto)
+}
+
+// Answered takes the time since Sent as a sample of the round trip time,
+// unless the packet was retransmitted or already answered.
+func (e *Estimator) Answered() {
+	if e.sent.IsZero() {
+		return
+	}
+	e.Sample(time.Since(e.sent))
+	e.sent = time.Time{}
+}
+
+// Sample updates the estimate with a round trip time of r.
+func (e *Estimator) Sample(r time.Duration) {
+	if e.srtt == 0 {
+		e.srtt = r
+		e.rttvar = r / 2
+	} else {
+		diff := e.srtt - r
+		if diff < 0 {
+			diff = -diff
+		}
+		e.rttvar = (3*e.rttvar + diff) / 4
+		e.srtt = (7*e.srtt + r) / 8
+	}
+	e.base = e.clamp(e.srtt + 4*e.rttvar)
+	e.rto = e.base
+}
+
+func (e *Estimator) clamp(d time.Duration) time.Duration {
+	if d < e.min {
+		return e.min
+	}
+	if e.max > 0 && d > e.max {
+		return e.max
+	}
+	return d
+}
@@ -0,0 +1,81 @@
+package rtt_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/whyrusleeping/go-tftp/internal/rtt"
+)
+
+func TestEstimator(t *testing.T) {
+	e := rtt.New(time.Second, 10*time.Millisecond, 10*time.Second)
+	if e.RTO() != time.Second {
+		t.Fatalf("initial RTO %v", e.RTO())
+	}
+
+	// rfc 6298: the first sample sets SRTT and half of it as RTTVAR
+	e.Sample(100 * time.Millisecond)
+	if e.SRTT() != 100*time.Millisecond || e.RTO() != 300*time.Millisecond {
+		t.Fatalf("after first sample SRTT %v RTO %v", e.SRTT(), e.RTO())
+	}
+
+	// A steady round trip time brings the timeout down towards it
+	for i := 0; i < 50; i++ {
+		e.Sample(100 * time.Millisecond)
+	}
+	if rto := e.RTO(); rto < 100*time.Millisecond || rto > 110*time.Millisecond {
+		t.Fatalf("steady RTO %v", rto)
+	}
+
+	// Jitter raises it again
+	e.Sample(300 * time.Millisecond)
+	if rto := e.RTO(); rto < 200*time.Millisecond {
+		t.Fatalf("RTO after jitter %v", rto)
+	}
+}
+
+func TestBounds(t *testing.T) {
+	e := rtt.New(time.Second, 50*time.Millisecond, 4*time.Second)
+	e.Sample(time.Millisecond)
+	if e.RTO() != 50*time.Millisecond {
+		t.Fatalf("RTO %v below floor", e.RTO())
+	}
+	for i := 0; i < 10; i++ {
+		e.Retransmitted()
+	}
+	if e.RTO() != 4*time.Second {
+		t.Fatalf("RTO %v above ceiling", e.RTO())
+	}
+}
+
+func TestKarn(t *testing.T) {
+	e := rtt.New(time.Second, time.Millisecond, time.Minute)
+
+	// The answer to a retransmitted packet is not timed, and the
+	// backed off timeout stands
+	e.Sent()
+	e.Retransmitted()
+	time.Sleep(5 * time.Millisecond)
+	e.Answered()
+	if e.SRTT() != 0 || e.RTO() != 2*time.Second {
+		t.Fatalf("SRTT %v RTO %v after retransmit", e.SRTT(), e.RTO())
+	}
+
+	// Only the first answer to a packet is timed, and a new packet
+	// starts over from the estimate
+	e.Sent()
+	if e.RTO() != time.Second {
+		t.Fatalf("RTO %v for a new packet", e.RTO())
+	}
+	time.Sleep(5 * time.Millisecond)
+	e.Answered()
+	srtt := e.SRTT()
+	if srtt < 5*time.Millisecond || srtt > time.Second {
+		t.Fatalf("SRTT %v", srtt)
+	}
+	time.Sleep(20 * time.Millisecond)
+	e.Answered()
+	if e.SRTT() != srtt {
+		t.Fatalf("SRTT changed by a duplicate answer to %v", e.SRTT())
+	}
+}
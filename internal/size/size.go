@@ -0,0 +1,37 @@
+// Package size finds the size of readers, for the tsize option of
+// rfc 2349.
+package size
+
+import (
+	"io"
+	"os"
+)
+
+// Of tries to find the number of bytes that can be read from r without
+// consuming any of it, returning -1 if that is not possible
+func Of(r io.Reader) int64 {
+	switch r := r.(type) {
+	case interface{ Stat() (os.FileInfo, error) }:
+		fi, err := r.Stat()
+		if err == nil && fi.Mode().IsRegular() {
+			return fi.Size()
+		}
+	case interface{ Len() int }:
+		return int64(r.Len())
+	case io.Seeker:
+		cur, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		end, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return -1
+		}
+		_, err = r.Seek(cur, io.SeekStart)
+		if err != nil {
+			return -1
+		}
+		return end - cur
+	}
+	return -1
+}
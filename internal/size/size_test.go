@@ -0,0 +1,49 @@
+package size_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/whyrusleeping/go-tftp/internal/size"
+)
+
+// seeker hides every method of its reader but Read and Seek
+type seeker struct{ io.ReadSeeker }
+
+func TestOf(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, make([]byte, 300), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	partly := strings.NewReader("0123456789")
+	partly.Seek(4, io.SeekStart)
+
+	cases := []struct {
+		name string
+		r    io.Reader
+		want int64
+	}{
+		{"file", f, 300},
+		{"buffer", bytes.NewBufferString("hello"), 5},
+		{"seeker", seeker{partly}, 6},
+		{"stream", io.MultiReader(strings.NewReader("hello")), -1},
+	}
+	for _, c := range cases {
+		if got := size.Of(c.r); got != c.want {
+			t.Errorf("%s: size %d, want %d", c.name, got, c.want)
+		}
+	}
+	if off, _ := partly.Seek(0, io.SeekCurrent); off != 4 {
+		t.Fatalf("seeker moved to %d", off)
+	}
+}
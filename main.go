@@ -1,22 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"github.com/whyrusleeping/go-tftp/server"
-	"io"
+	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
-func reader(path string) (r io.Reader, err error) {
-	r, err = os.Open(path)
-	return
-}
-
-func writer(path string) (w io.Writer, err error) {
-	w, err = os.Create(path)
-	return
-}
-
 func main() {
 	cwd, err := os.Getwd()
 	if err != nil {
@@ -26,8 +21,47 @@ func main() {
 	dir := flag.String("dir", cwd, "specify a directory to serve files from")
 	port := flag.String("port", "6900", "specify a port to listen on")
 	address := flag.String("address", "", "specify address to listen on")
+	remap := flag.String("m", "", "specify a file of filename remapping rules")
+	singlePort := flag.Bool("single-port", false, "specify to keep all transfers on the listening port")
+	maxSessions := flag.Int("max-sessions", 0, "specify the most transfers to run at once, 0 for no limit")
+	maxPending := flag.Int("max-pending", 0, "specify how many requests may wait for a transfer to end")
+	maxPerIP := flag.Int("max-per-ip", 0, "specify the most requests to take from each client address, 0 for no limit")
+	grace := flag.Duration("grace", 30*time.Second, "specify how long to let transfers finish when stopping")
 	flag.Parse()
 
-	srv := server.NewServer(*dir, reader, writer)
-	panic(srv.Serve(*address + ":" + *port))
+	srv := server.NewFSServer(server.DirFS(*dir))
+	srv.SinglePort = *singlePort
+	srv.MaxSessions = *maxSessions
+	srv.MaxPending = *maxPending
+	srv.MaxSessionsPerIP = *maxPerIP
+	if *remap != "" {
+		srv.Remap, err = server.LoadRemap(*remap)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// Stop taking requests on SIGINT or SIGTERM, and give running
+	// transfers a chance to finish
+	stopped := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Println("shutting down")
+
+		ctx, cancel := context.WithTimeout(context.Background(), *grace)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Println("aborting transfers:", err)
+			srv.Close()
+		}
+		close(stopped)
+	}()
+
+	err = srv.ListenAndServe(*address + ":" + *port)
+	if !errors.Is(err, server.ErrServerClosed) {
+		panic(err)
+	}
+	<-stopped
 }
@@ -0,0 +1,15 @@
+//go:build !plan9
+
+package packet
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isDiskFull reports whether err means there is no room left to write
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) ||
+		errors.Is(err, syscall.EDQUOT) ||
+		errors.Is(err, syscall.EFBIG)
+}
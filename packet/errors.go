@@ -0,0 +1,93 @@
+package packet
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// Sentinel errors for each TFTP error code, for use with errors.Is.
+// Any ErrorPacket matches the sentinel with the same code, so errors
+// received from a peer can be told apart without looking at the
+// message text.
+var (
+	ErrNotFound        = &ErrorPacket{Code: TFTPErrNotFound}
+	ErrAccessViolation = &ErrorPacket{Code: TFTPErrAccessViolation}
+	ErrDiskFull        = &ErrorPacket{Code: TFTPErrDiskFull}
+	ErrIllegalOp       = &ErrorPacket{Code: TFTPErrIllegalOp}
+	ErrUnknownTID      = &ErrorPacket{Code: TFTPErrUnknownTID}
+	ErrAlreadyExists   = &ErrorPacket{Code: TFTPErrAlreadyExists}
+	ErrNoSuchUser      = &ErrorPacket{Code: TFTPErrNoSuchUser}
+	ErrOptionRefused   = &ErrorPacket{Code: TFTPErrOptionRefused}
+)
+
+// errorMessages are the default messages for each error code
+var errorMessages = map[uint16]string{
+	TFTPErrUndefined:       "undefined error",
+	TFTPErrNotFound:        "file not found",
+	TFTPErrAccessViolation: "access violation",
+	TFTPErrDiskFull:        "disk full or allocation exceeded",
+	TFTPErrIllegalOp:       "illegal TFTP operation",
+	TFTPErrUnknownTID:      "unknown transfer ID",
+	TFTPErrAlreadyExists:   "file already exists",
+	TFTPErrNoSuchUser:      "no such user",
+	TFTPErrOptionRefused:   "option negotiation refused",
+}
+
+// Is reports whether target is an ErrorPacket with the same code, or
+// the io/fs error corresponding to the code. This lets an error from
+// the peer be checked with errors.Is(err, fs.ErrNotExist).
+func (p *ErrorPacket) Is(target error) bool {
+	if t, ok := target.(*ErrorPacket); ok {
+		return t.Code == p.Code
+	}
+	switch p.Code {
+	case TFTPErrNotFound:
+		return target == fs.ErrNotExist
+	case TFTPErrAccessViolation:
+		return target == fs.ErrPermission
+	case TFTPErrAlreadyExists:
+		return target == fs.ErrExist
+	}
+	return false
+}
+
+// NewErrorPacket returns the error packet to send a peer for err. An
+// ErrorPacket is returned as is, with the default message for its code
+// if it has none, such as the sentinels. io/fs and disk space errors get
+// their matching code and a generic message so that local paths are not
+// leaked, and anything else is sent as an undefined error, with only the
+// underlying error of an *fs.PathError or *os.LinkError.
+func NewErrorPacket(err error) *ErrorPacket {
+	var ep *ErrorPacket
+	if errors.As(err, &ep) {
+		if ep.Value == "" {
+			return &ErrorPacket{Code: ep.Code, Value: errorMessages[ep.Code]}
+		}
+		return ep
+	}
+
+	code := TFTPErrUndefined
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		code = TFTPErrNotFound
+	case errors.Is(err, fs.ErrPermission):
+		code = TFTPErrAccessViolation
+	case errors.Is(err, fs.ErrExist):
+		code = TFTPErrAlreadyExists
+	case isDiskFull(err):
+		code = TFTPErrDiskFull
+	default:
+		// Still only what went wrong, not where
+		var perr *fs.PathError
+		var lerr *os.LinkError
+		switch {
+		case errors.As(err, &perr):
+			return &ErrorPacket{Code: code, Value: perr.Err.Error()}
+		case errors.As(err, &lerr):
+			return &ErrorPacket{Code: code, Value: lerr.Err.Error()}
+		}
+		return &ErrorPacket{Code: code, Value: err.Error()}
+	}
+	return &ErrorPacket{Code: code, Value: errorMessages[code]}
+}
@@ -0,0 +1,40 @@
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func FuzzParsePacket(f *testing.F) {
+	f.Add(NewAck(1).Bytes())
+	f.Add((&DataPacket{BlockNum: 65535, Data: []byte("hello")}).Bytes())
+	f.Add((&ErrorPacket{Code: TFTPErrNotFound, Value: "file not found"}).Bytes())
+	f.Add((&ReqPacket{Type: RRQ, Filename: "pxelinux.0", Mode: "octet", BlockSize: 1428}).Bytes())
+	f.Add([]byte("\x00\x02upload\x00netascii\x00tsize\x00100\x00windowsize\x0016\x00"))
+	f.Add([]byte("\x00\x06blksize\x001428\x00tsize\x000\x00"))
+	f.Add([]byte("\x00\x01"))
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		p, err := ParsePacket(buf)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidPacket) {
+				t.Fatalf("error %v does not match ErrInvalidPacket", err)
+			}
+			return
+		}
+
+		// Anything accepted must survive a round trip unchanged
+		out := p.Bytes()
+		p2, err := ParsePacket(out)
+		if err != nil {
+			t.Fatalf("reparsing %q: %s", out, err)
+		}
+		if p2.GetType() != p.GetType() {
+			t.Fatalf("type changed from %d to %d", p.GetType(), p2.GetType())
+		}
+		if !bytes.Equal(p2.Bytes(), out) {
+			t.Fatalf("reserialized %q as %q", out, p2.Bytes())
+		}
+	})
+}
@@ -0,0 +1,144 @@
+package packet
+
+import (
+	"io"
+)
+
+// Transfer modes as defined in rfc 1350. Modes are matched
+// case-insensitively.
+const (
+	ModeNetascii = "netascii"
+	ModeOctet    = "octet"
+	ModeMail     = "mail"
+)
+
+// NetasciiReader encodes text read from an underlying reader as
+// netascii, turning LF into CR LF and a bare CR into CR NUL.
+type NetasciiReader struct {
+	r       io.Reader
+	scratch []byte
+
+	// pending holds the second byte of a pair that did not fit
+	// into the callers buffer
+	pending    byte
+	hasPending bool
+}
+
+// NewNetasciiReader returns a NetasciiReader reading from r
+func NewNetasciiReader(r io.Reader) *NetasciiReader {
+	return &NetasciiReader{r: r}
+}
+
+func (n *NetasciiReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	i := 0
+	if n.hasPending {
+		p[0] = n.pending
+		n.hasPending = false
+		i = 1
+		if i == len(p) {
+			return i, nil
+		}
+	}
+
+	// Every byte read expands to at most two
+	want := (len(p) - i) / 2
+	if want == 0 {
+		want = 1
+	}
+	if cap(n.scratch) < want {
+		n.scratch = make([]byte, want)
+	}
+	m, err := n.r.Read(n.scratch[:want])
+	for _, c := range n.scratch[:m] {
+		var next byte
+		switch c {
+		case '\n':
+			c, next = '\r', '\n'
+		case '\r':
+			next = 0
+		default:
+			p[i] = c
+			i++
+			continue
+		}
+
+		p[i] = c
+		i++
+		if i < len(p) {
+			p[i] = next
+			i++
+		} else {
+			n.pending = next
+			n.hasPending = true
+		}
+	}
+
+	if n.hasPending && err == io.EOF {
+		// Hand out the pending byte before reporting EOF
+		err = nil
+	}
+	return i, err
+}
+
+// NetasciiWriter decodes netascii written to it, turning CR LF into
+// LF and CR NUL into CR, before writing it to an underlying writer.
+// Flush must be called once all data has been written.
+type NetasciiWriter struct {
+	w   io.Writer
+	buf []byte
+
+	// cr is set when the last byte written was a CR, whose meaning
+	// depends on the byte that follows it
+	cr bool
+}
+
+// NewNetasciiWriter returns a NetasciiWriter writing to w
+func NewNetasciiWriter(w io.Writer) *NetasciiWriter {
+	return &NetasciiWriter{w: w}
+}
+
+func (n *NetasciiWriter) Write(p []byte) (int, error) {
+	out := n.buf[:0]
+	for _, c := range p {
+		if n.cr {
+			n.cr = false
+			switch c {
+			case '\n':
+				out = append(out, '\n')
+				continue
+			case 0:
+				out = append(out, '\r')
+				continue
+			default:
+				// Not valid netascii, pass the CR through as is
+				out = append(out, '\r')
+			}
+		}
+		if c == '\r' {
+			n.cr = true
+			continue
+		}
+		out = append(out, c)
+	}
+	n.buf = out
+
+	_, err := n.w.Write(out)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes out a CR left over at the end of the data, if any
+func (n *NetasciiWriter) Flush() error {
+	if !n.cr {
+		return nil
+	}
+	n.cr = false
+	_, err := n.w.Write([]byte{'\r'})
+	return err
+}
@@ -0,0 +1,62 @@
+package packet
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+var netasciiCases = []struct {
+	text, netascii string
+}{
+	{"hello world", "hello world"},
+	{"line one\nline two\n", "line one\r\nline two\r\n"},
+	{"bare\rcr", "bare\r\x00cr"},
+	{"\r\n", "\r\x00\r\n"},
+	{"\n\n\r\r", "\r\n\r\n\r\x00\r\x00"},
+}
+
+func TestNetasciiReader(t *testing.T) {
+	for _, c := range netasciiCases {
+		// A one byte buffer forces pairs to be split across reads
+		for _, size := range []int{1, 2, 3, 512} {
+			r := NewNetasciiReader(bytes.NewReader([]byte(c.text)))
+			out := new(bytes.Buffer)
+			buf := make([]byte, size)
+			for {
+				n, err := r.Read(buf)
+				out.Write(buf[:n])
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if out.String() != c.netascii {
+				t.Fatalf("encoding %q with %d byte reads gave %q, expected %q", c.text, size, out.String(), c.netascii)
+			}
+		}
+	}
+}
+
+func TestNetasciiWriter(t *testing.T) {
+	for _, c := range netasciiCases {
+		// Write a byte at a time so pairs are split across writes
+		out := new(bytes.Buffer)
+		w := NewNetasciiWriter(out)
+		for i := 0; i < len(c.netascii); i++ {
+			_, err := w.Write([]byte{c.netascii[i]})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := w.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != c.text {
+			t.Fatalf("decoding %q gave %q, expected %q", c.netascii, out.String(), c.text)
+		}
+	}
+}
@@ -4,19 +4,13 @@ package packet
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"log"
+	"strings"
 )
 
 var _ = log.Fatal
 
-// ErrInvalidPacket is returned when given malformed data
-var ErrInvalidPacket = errors.New("invalid packet")
-
-// ErrPacketType is returned when given an invalid packet type value
-var ErrPacketType = errors.New("unrecognized packet type")
-
 // Packet Type codes as defined in rfc 1350
 const (
 	RRQ = uint16(iota + 1)
@@ -36,10 +30,80 @@ type Packet interface {
 	Bytes() []byte
 }
 
+// Option names defined by the TFTP option extension RFCs
+const (
+	OptBlockSize    = "blksize"
+	OptTransferSize = "tsize"
+	OptTimeout      = "timeout"
+	OptWindowSize   = "windowsize"
+	// OptRollover is the de-facto option choosing whether block
+	// numbers wrap around to 0 or 1 after 65535
+	OptRollover = "rollover"
+	// OptUTimeout is the tftp-hpa extension of the timeout option,
+	// giving the timeout in microseconds rather than seconds
+	OptUTimeout = "utimeout"
+)
+
+// Option is a single option name and value pair as described in rfc 2347
+type Option struct {
+	Name  string
+	Value string
+}
+
+// Options is an ordered list of options. Option names are matched
+// case-insensitively, and the order is preserved when serialized.
+type Options []Option
+
+// Get returns the value of the named option, and whether it was present
+func (o Options) Get(name string) (string, bool) {
+	for _, opt := range o {
+		if strings.EqualFold(opt.Name, name) {
+			return opt.Value, true
+		}
+	}
+	return "", false
+}
+
+// Set replaces the value of the named option, or appends it
+// if it is not yet present
+func (o *Options) Set(name, value string) {
+	for i, opt := range *o {
+		if strings.EqualFold(opt.Name, name) {
+			(*o)[i].Value = value
+			return
+		}
+	}
+	*o = append(*o, Option{Name: name, Value: value})
+}
+
+// Del removes the named option
+func (o *Options) Del(name string) {
+	out := (*o)[:0]
+	for _, opt := range *o {
+		if !strings.EqualFold(opt.Name, name) {
+			out = append(out, opt)
+		}
+	}
+	*o = out
+}
+
+func (o Options) write(buf *bytes.Buffer) {
+	for _, opt := range o {
+		buf.WriteString(opt.Name)
+		buf.WriteByte(0)
+		buf.WriteString(opt.Value)
+		buf.WriteByte(0)
+	}
+}
+
 type ReqPacket struct {
-	Filename  string
-	Mode      string
-	Type      uint16
+	Filename string
+	Mode     string
+	Type     uint16
+	Options  Options
+
+	// BlockSize is sent as the blksize option if it is not already
+	// present in Options, and is filled in from it when parsing
 	BlockSize int
 }
 
@@ -47,10 +111,6 @@ func (p *ReqPacket) GetType() uint16 {
 	return p.Type
 }
 
-// we will never need to serialize a Request Packet
-// as the server, so it is safe to return nil just to
-// satisfy the interface (consider adding this later for
-// client use)
 func (p *ReqPacket) Bytes() []byte {
 	buf := new(bytes.Buffer)
 	opcode := make([]byte, 2)
@@ -60,8 +120,9 @@ func (p *ReqPacket) Bytes() []byte {
 	buf.WriteByte(0)
 	buf.WriteString(p.Mode)
 	buf.WriteByte(0)
-	if p.BlockSize != 0 && p.BlockSize != 512 {
-		buf.WriteString("blksize")
+	p.Options.write(buf)
+	if _, ok := p.Options.Get(OptBlockSize); !ok && p.BlockSize != 0 && p.BlockSize != 512 {
+		buf.WriteString(OptBlockSize)
 		buf.WriteByte(0)
 		buf.WriteString(fmt.Sprint(p.BlockSize))
 		buf.WriteByte(0)
@@ -69,6 +130,15 @@ func (p *ReqPacket) Bytes() []byte {
 	return buf.Bytes()
 }
 
+// NextBlockNum returns the block number following n, wrapping
+// around to rollover (0 or 1) after 65535
+func NextBlockNum(n, rollover uint16) uint16 {
+	if n == 0xffff {
+		return rollover
+	}
+	return n + 1
+}
+
 type DataPacket struct {
 	Data     []byte
 	BlockNum uint16
@@ -108,6 +178,9 @@ func (p *AckPacket) Bytes() []byte {
 	return buf
 }
 
+// ErrorPacket is a TFTP error, and can be used as a Go error. It
+// matches the sentinel error for its code with errors.Is, see
+// errors.go.
 type ErrorPacket struct {
 	Code  uint16
 	Value string
@@ -122,17 +195,25 @@ const (
 	TFTPErrUnknownTID
 	TFTPErrAlreadyExists
 	TFTPErrNoSuchUser
+	// TFTPErrOptionRefused is sent to terminate a transfer
+	// during option negotiation, as defined in rfc 2347
+	TFTPErrOptionRefused
 )
 
 func (p *ErrorPacket) Error() string {
+	if p.Value == "" {
+		return errorMessages[p.Code]
+	}
 	return p.Value
 }
 
 func (p *ErrorPacket) Bytes() []byte {
-	buf := make([]byte, 4+len(p.Value))
+	buf := make([]byte, 4+len(p.Value)+1)
 	binary.BigEndian.PutUint16(buf[:2], ERROR)
 	binary.BigEndian.PutUint16(buf[2:4], p.Code)
 	copy(buf[4:], p.Value)
+	// The message is NUL terminated
+	buf[len(buf)-1] = 0
 	return buf
 }
 
@@ -140,65 +221,26 @@ func (p *ErrorPacket) GetType() uint16 {
 	return ERROR
 }
 
+// OAckPacket acknowledges the options a server accepted. Options
+// are serialized in the order they were added, which should follow
+// the order of the request being answered.
 type OAckPacket struct {
-	Options map[string]string
+	Options Options
 }
 
 func NewOAckPacket() *OAckPacket {
-	return &OAckPacket{
-		Options: make(map[string]string),
-	}
+	return &OAckPacket{}
 }
 
 func (oa *OAckPacket) Bytes() []byte {
-	panic("Not yet implemented!")
+	buf := new(bytes.Buffer)
+	opcode := make([]byte, 2)
+	binary.BigEndian.PutUint16(opcode, OACK)
+	buf.Write(opcode)
+	oa.Options.write(buf)
+	return buf.Bytes()
 }
 
 func (oa *OAckPacket) GetType() uint16 {
 	return OACK
 }
-
-// ReadPacket deserializes a packet from the given buffer
-func ParsePacket(buf []byte) (Packet, error) {
-	if len(buf) < 2 {
-		return nil, ErrInvalidPacket
-	}
-
-	pktType := binary.BigEndian.Uint16(buf[0:2])
-	switch pktType {
-	case RRQ, WRQ:
-		vals := bytes.Split(buf[2:], []byte{0})
-		if len(vals) < 2 {
-			return nil, ErrInvalidPacket
-		}
-		return &ReqPacket{
-			Type:     pktType,
-			Filename: string(vals[0]),
-			Mode:     string(vals[1]),
-		}, nil
-	case ACK:
-		blknum := binary.BigEndian.Uint16(buf[2:4])
-		return NewAck(blknum), nil
-	case DATA:
-		blknum := binary.BigEndian.Uint16(buf[2:4])
-		return &DataPacket{
-			BlockNum: blknum,
-			Data:     buf[4:],
-		}, nil
-	case ERROR:
-		errcode := binary.BigEndian.Uint16(buf[2:4])
-		return &ErrorPacket{
-			Code:  errcode,
-			Value: string(buf[4:]),
-		}, nil
-	case OACK:
-		oack := NewOAckPacket()
-		vals := bytes.Split(buf[2:], []byte{0})
-		for i := 0; i+1 < len(vals); i += 2 {
-			oack.Options[string(vals[i])] = string(vals[i+1])
-		}
-		return oack, nil
-	default:
-		return nil, ErrPacketType
-	}
-}
@@ -2,6 +2,11 @@ package packet
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -51,3 +56,188 @@ func TestDataSerialization(t *testing.T) {
 		t.Fatal("Data mismatch!")
 	}
 }
+
+func TestRequestOptionSerialization(t *testing.T) {
+	req := &ReqPacket{
+		Type:     RRQ,
+		Filename: "pxelinux.0",
+		Mode:     "octet",
+		Options: Options{
+			{Name: "TSize", Value: "0"},
+			{Name: "blksize", Value: "1428"},
+		},
+	}
+
+	exp, err := ParsePacket(req.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqpkt, ok := exp.(*ReqPacket)
+	if !ok {
+		t.Fatal("type assertion failed")
+	}
+
+	if reqpkt.Filename != req.Filename || reqpkt.Mode != req.Mode {
+		t.Fatal("Wrong filename or mode")
+	}
+	if reqpkt.BlockSize != 1428 {
+		t.Fatal("BlockSize not filled in from options")
+	}
+	if v, ok := reqpkt.Options.Get("tsize"); !ok || v != "0" {
+		t.Fatal("Option lookup should be case insensitive")
+	}
+	if !bytes.Equal(reqpkt.Bytes(), req.Bytes()) {
+		t.Fatal("Reserialized request differs")
+	}
+}
+
+func TestOAckSerialization(t *testing.T) {
+	oack := NewOAckPacket()
+	oack.Options.Set("tsize", "1048576")
+	oack.Options.Set("blksize", "1428")
+	oack.Options.Set("timeout", "1")
+
+	exp, err := ParsePacket(oack.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oackpkt, ok := exp.(*OAckPacket)
+	if !ok {
+		t.Fatal("type assertion failed")
+	}
+
+	if len(oackpkt.Options) != 3 {
+		t.Fatal("Wrong number of options")
+	}
+	for i, opt := range oack.Options {
+		if oackpkt.Options[i] != opt {
+			t.Fatalf("Option %d out of order: %v", i, oackpkt.Options[i])
+		}
+	}
+}
+
+func TestNextBlockNum(t *testing.T) {
+	if NextBlockNum(1, 0) != 2 {
+		t.Fatal("Wrong next block")
+	}
+	if NextBlockNum(65535, 0) != 0 {
+		t.Fatal("Should wrap around to 0")
+	}
+	if NextBlockNum(65535, 1) != 1 {
+		t.Fatal("Should wrap around to 1")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	long := append([]byte("\x00\x01"), bytes.Repeat([]byte("a"), MaxRequestSize)...)
+	long = append(long, "\x00octet\x00"...)
+
+	cases := []struct {
+		name string
+		buf  string
+		err  error
+	}{
+		{"empty", "", ErrTruncated},
+		{"one byte", "\x00", ErrTruncated},
+		{"bare ack", "\x00\x04", ErrTruncated},
+		{"short ack", "\x00\x04\x01", ErrTruncated},
+		{"bare data", "\x00\x03", ErrTruncated},
+		{"bare error", "\x00\x05\x00", ErrTruncated},
+		{"bad opcode", "\x00\x07\x00\x01", ErrPacketType},
+		{"zero opcode", "\x00\x00", ErrPacketType},
+		{"unterminated filename", "\x00\x01file", ErrMissingTerminator},
+		{"unterminated mode", "\x00\x01file\x00octet", ErrMissingTerminator},
+		{"missing mode", "\x00\x01file\x00", ErrTruncated},
+		{"bad mode", "\x00\x01file\x00binary\x00", ErrBadMode},
+		{"option without value", "\x00\x01file\x00octet\x00blksize\x00", ErrBadOption},
+		{"empty option name", "\x00\x01file\x00octet\x00\x001428\x00", ErrBadOption},
+		{"unterminated option", "\x00\x02file\x00octet\x00blksize\x001428", ErrMissingTerminator},
+		{"duplicate option", "\x00\x01file\x00octet\x00blksize\x00512\x00BLKSIZE\x001428\x00", ErrDuplicateOption},
+		{"oversized request", string(long), ErrRequestTooLarge},
+		{"unterminated oack", "\x00\x06blksize\x00512", ErrMissingTerminator},
+		{"oack without value", "\x00\x06blksize\x00", ErrBadOption},
+	}
+
+	for _, c := range cases {
+		_, err := ParsePacket([]byte(c.buf))
+		if !errors.Is(err, c.err) {
+			t.Fatalf("%s: got error %v, expected %v", c.name, err, c.err)
+		}
+		if !errors.Is(err, ErrInvalidPacket) {
+			t.Fatalf("%s: error %v should match ErrInvalidPacket", c.name, err)
+		}
+	}
+}
+
+func TestErrorSerialization(t *testing.T) {
+	epkt := &ErrorPacket{
+		Code:  TFTPErrNotFound,
+		Value: "no such file",
+	}
+
+	buf := epkt.Bytes()
+	if buf[len(buf)-1] != 0 {
+		t.Fatal("Error message not NUL terminated")
+	}
+
+	experr, err := ParsePacket(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errpkt, ok := experr.(*ErrorPacket)
+	if !ok {
+		t.Fatal("type assertion failed")
+	}
+	if *errpkt != *epkt {
+		t.Fatalf("Wrong error packet: %v", errpkt)
+	}
+}
+
+func TestErrorMapping(t *testing.T) {
+	received := &ErrorPacket{Code: TFTPErrNotFound, Value: "no such file"}
+	if !errors.Is(received, ErrNotFound) || !errors.Is(received, fs.ErrNotExist) {
+		t.Fatal("Error should match ErrNotFound and fs.ErrNotExist")
+	}
+	if errors.Is(received, ErrAccessViolation) || errors.Is(received, fs.ErrPermission) {
+		t.Fatal("Error should not match other codes")
+	}
+	wrapped := fmt.Errorf("fetching: %w", &ErrorPacket{Code: TFTPErrOptionRefused})
+	if !errors.Is(wrapped, ErrOptionRefused) {
+		t.Fatal("Wrapped error should match ErrOptionRefused")
+	}
+
+	cases := []struct {
+		err  error
+		code uint16
+	}{
+		{&fs.PathError{Op: "open", Path: "/srv/tftp/x", Err: fs.ErrNotExist}, TFTPErrNotFound},
+		{fs.ErrPermission, TFTPErrAccessViolation},
+		{fs.ErrExist, TFTPErrAlreadyExists},
+		{ErrDiskFull, TFTPErrDiskFull},
+		{errors.New("something broke"), TFTPErrUndefined},
+	}
+	for _, c := range cases {
+		epkt := NewErrorPacket(c.err)
+		if epkt.Code != c.code {
+			t.Fatalf("%v mapped to code %d, expected %d", c.err, epkt.Code, c.code)
+		}
+		if strings.Contains(epkt.Value, "/srv/tftp") {
+			t.Fatal("Error message leaks the local path")
+		}
+		if epkt.Value == "" {
+			t.Fatalf("%v mapped to an empty message", c.err)
+		}
+	}
+
+	// Undefined errors keep their message, but not the paths in it
+	ioErr := errors.New("input/output error")
+	for _, err := range []error{
+		&fs.PathError{Op: "read", Path: "/srv/tftp/x", Err: ioErr},
+		fmt.Errorf("saving: %w", &os.LinkError{Op: "rename", Old: "/srv/tftp/x.tmp", New: "/srv/tftp/x", Err: ioErr}),
+	} {
+		epkt := NewErrorPacket(err)
+		if epkt.Code != TFTPErrUndefined || epkt.Value != ioErr.Error() {
+			t.Fatalf("%v mapped to %d %q", err, epkt.Code, epkt.Value)
+		}
+	}
+}
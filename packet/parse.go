@@ -0,0 +1,196 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaxRequestSize is the largest request packet accepted, rfc 2347
+// limits requests including their options to 512 bytes
+const MaxRequestSize = 512
+
+// ErrInvalidPacket is returned when given malformed data. Every error
+// returned by ParsePacket matches it with errors.Is.
+var ErrInvalidPacket = errors.New("invalid packet")
+
+// ErrPacketType is returned when given an invalid packet type value
+var ErrPacketType = errors.New("unrecognized packet type")
+
+// Reasons a packet can be rejected by ParsePacket, wrapped in a ParseError
+var (
+	// ErrTruncated is returned when a packet ends before all of its
+	// fields are present
+	ErrTruncated = errors.New("packet truncated")
+
+	// ErrMissingTerminator is returned when a string field is not
+	// terminated by a NUL byte
+	ErrMissingTerminator = errors.New("missing NUL terminator")
+
+	// ErrBadMode is returned for a request with an unknown transfer mode
+	ErrBadMode = errors.New("unknown transfer mode")
+
+	// ErrBadOption is returned for an option with an empty name
+	// or without a value
+	ErrBadOption = errors.New("malformed option")
+
+	// ErrDuplicateOption is returned when an option appears twice
+	ErrDuplicateOption = errors.New("duplicate option")
+
+	// ErrRequestTooLarge is returned for a request packet larger
+	// than MaxRequestSize
+	ErrRequestTooLarge = errors.New("request too large")
+)
+
+// ParseError describes a packet that ParsePacket rejected
+type ParseError struct {
+	// Opcode is the type of the packet, or 0 if it was too short
+	// to contain one
+	Opcode uint16
+	// Err is one of the errors above describing what was wrong
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("invalid packet (opcode %d): %s", e.Opcode, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes every ParseError match ErrInvalidPacket
+func (e *ParseError) Is(target error) bool {
+	return target == ErrInvalidPacket
+}
+
+// ParsePacket deserializes a packet from the given buffer. The buffer
+// is not retained, except by the Data of a DataPacket.
+func ParsePacket(buf []byte) (Packet, error) {
+	if len(buf) < 2 {
+		return nil, &ParseError{Err: ErrTruncated}
+	}
+
+	pktType := binary.BigEndian.Uint16(buf[0:2])
+	fail := func(err error) (Packet, error) {
+		return nil, &ParseError{Opcode: pktType, Err: err}
+	}
+
+	switch pktType {
+	case RRQ, WRQ:
+		if len(buf) > MaxRequestSize {
+			return fail(ErrRequestTooLarge)
+		}
+		vals, err := splitFields(buf[2:])
+		if err != nil {
+			return fail(err)
+		}
+		if len(vals) < 2 {
+			return fail(ErrTruncated)
+		}
+		switch strings.ToLower(string(vals[1])) {
+		case ModeNetascii, ModeOctet, ModeMail:
+		default:
+			return fail(ErrBadMode)
+		}
+		opts, err := parseOptions(vals[2:])
+		if err != nil {
+			return fail(err)
+		}
+		req := &ReqPacket{
+			Type:     pktType,
+			Filename: string(vals[0]),
+			Mode:     string(vals[1]),
+			Options:  opts,
+		}
+		if v, ok := req.Options.Get(OptBlockSize); ok {
+			if bs, err := strconv.Atoi(v); err == nil {
+				req.BlockSize = bs
+			}
+		}
+		return req, nil
+	case ACK:
+		// Anything after the block number is ignored, some
+		// clients pad their ACKs
+		if len(buf) < 4 {
+			return fail(ErrTruncated)
+		}
+		blknum := binary.BigEndian.Uint16(buf[2:4])
+		return NewAck(blknum), nil
+	case DATA:
+		if len(buf) < 4 {
+			return fail(ErrTruncated)
+		}
+		blknum := binary.BigEndian.Uint16(buf[2:4])
+		return &DataPacket{
+			BlockNum: blknum,
+			Data:     buf[4:],
+		}, nil
+	case ERROR:
+		if len(buf) < 4 {
+			return fail(ErrTruncated)
+		}
+		errcode := binary.BigEndian.Uint16(buf[2:4])
+		// The message should be NUL terminated, but plenty of
+		// implementations leave it off so it is not required
+		msg := buf[4:]
+		if i := bytes.IndexByte(msg, 0); i >= 0 {
+			msg = msg[:i]
+		}
+		return &ErrorPacket{
+			Code:  errcode,
+			Value: string(msg),
+		}, nil
+	case OACK:
+		vals, err := splitFields(buf[2:])
+		if err != nil {
+			return fail(err)
+		}
+		opts, err := parseOptions(vals)
+		if err != nil {
+			return fail(err)
+		}
+		oack := NewOAckPacket()
+		oack.Options = opts
+		return oack, nil
+	default:
+		return fail(ErrPacketType)
+	}
+}
+
+// splitFields splits a sequence of NUL terminated strings
+func splitFields(buf []byte) ([][]byte, error) {
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	if buf[len(buf)-1] != 0 {
+		return nil, ErrMissingTerminator
+	}
+	return bytes.Split(buf[:len(buf)-1], []byte{0}), nil
+}
+
+// parseOptions reads the name and value pairs that follow the header
+// of a request or OACK packet
+func parseOptions(vals [][]byte) (Options, error) {
+	if len(vals)%2 != 0 {
+		return nil, ErrBadOption
+	}
+	var opts Options
+	for i := 0; i < len(vals); i += 2 {
+		name := string(vals[i])
+		if name == "" {
+			return nil, ErrBadOption
+		}
+		if _, ok := opts.Get(name); ok {
+			return nil, ErrDuplicateOption
+		}
+		opts = append(opts, Option{
+			Name:  name,
+			Value: string(vals[i+1]),
+		})
+	}
+	return opts, nil
+}
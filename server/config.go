@@ -0,0 +1,63 @@
+package server
+
+import "time"
+
+// DefaultRetransmitTime is the retransmit timeout of transfers until
+// the round trip time to the client is measured.
+const DefaultRetransmitTime = time.Second
+
+// DefaultRetries is how often a packet is retransmitted without reply
+// before a transfer is given up.
+const DefaultRetries = 5
+
+// DefaultMinTimeout and DefaultMaxTimeout bound the retransmit timeout.
+const (
+	DefaultMinTimeout = time.Millisecond * 50
+	DefaultMaxTimeout = time.Second * 8
+)
+
+// Config holds the retransmit settings of a server. Zero values select
+// the defaults.
+type Config struct {
+	// RetransmitTime is the retransmit timeout a transfer starts with.
+	// After that it follows the round trip time measured to the client.
+	RetransmitTime time.Duration
+
+	// MinTimeout and MaxTimeout bound the retransmit timeout, which
+	// doubles with every retransmit of the same packet. A timeout
+	// negotiated with the client is never undercut.
+	MinTimeout time.Duration
+	MaxTimeout time.Duration
+
+	// Retries is how often a packet is retransmitted without a reply
+	// before the transfer is given up.
+	Retries int
+}
+
+func (c *Config) retransmitTime() time.Duration {
+	if c.RetransmitTime > 0 {
+		return c.RetransmitTime
+	}
+	return DefaultRetransmitTime
+}
+
+func (c *Config) minTimeout() time.Duration {
+	if c.MinTimeout > 0 {
+		return c.MinTimeout
+	}
+	return DefaultMinTimeout
+}
+
+func (c *Config) maxTimeout() time.Duration {
+	if c.MaxTimeout > 0 {
+		return c.MaxTimeout
+	}
+	return DefaultMaxTimeout
+}
+
+func (c *Config) retries() int {
+	if c.Retries > 0 {
+		return c.Retries
+	}
+	return DefaultRetries
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+
+	pkt "github.com/whyrusleeping/go-tftp/packet"
+)
+
+// errUnknownTID is sent in reply to packets from anyone but the peer of
+// a transfer
+var errUnknownTID = &pkt.ErrorPacket{Code: pkt.TFTPErrUnknownTID, Value: "unknown transfer ID"}
+
+// transferConn is the socket of a single transfer, which only
+// exchanges packets with peer, the client that made the request.
+type transferConn struct {
+	net.PacketConn
+	peer net.Addr
+	// flight, if set, is told of the first packet sent
+	flight *flight
+}
+
+// listenUDP opens a UDP socket on a free port
+func listenUDP() (net.PacketConn, error) {
+	return net.ListenPacket("udp", ":0")
+}
+
+// dial opens the socket for a transfer with addr, or returns the
+// session of addr in single port mode
+func (s *Server) dial(addr *net.UDPAddr) (*transferConn, error) {
+	if sc := s.sessions.get(addr); sc != nil {
+		// Single port mode
+		return &transferConn{PacketConn: sc, peer: addr}, nil
+	}
+
+	listen := s.ListenTransfer
+	if listen == nil {
+		listen = listenUDP
+	}
+	c, err := listen()
+	if err != nil {
+		return nil, err
+	}
+	return &transferConn{PacketConn: c, peer: addr}, nil
+}
+
+// Write sends b to the peer
+func (c *transferConn) Write(b []byte) (int, error) {
+	if c.flight != nil {
+		c.flight.answered(c, b)
+	}
+	return c.WriteTo(b, c.peer)
+}
+
+// Read reads the next packet from the peer into b. Packets from anyone
+// else are answered with an unknown transfer ID error (rfc 1350), and
+// the transfer carries on.
+func (c *transferConn) Read(b []byte) (int, error) {
+	for {
+		n, addr, err := c.ReadFrom(b)
+		if err != nil {
+			return n, err
+		}
+		if addr.String() == c.peer.String() {
+			return n, nil
+		}
+		log.Printf("packet from unknown peer %s", addr)
+		if !isError(b[:n]) {
+			c.WriteTo(errUnknownTID.Bytes(), addr)
+		}
+	}
+}
+
+// isError reports whether p is an error packet, which is never
+// answered so that two peers cannot keep sending each other errors
+func isError(p []byte) bool {
+	return len(p) >= 2 && binary.BigEndian.Uint16(p) == pkt.ERROR
+}
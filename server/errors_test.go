@@ -0,0 +1,239 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	pkt "github.com/whyrusleeping/go-tftp/packet"
+	"github.com/whyrusleeping/go-tftp/server"
+)
+
+// failWriter fails every write
+type failWriter struct{}
+
+func (failWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk on fire")
+}
+
+// rawPacket is sent as is, to test the replies to malformed packets
+type rawPacket []byte
+
+func (p rawPacket) GetType() uint16 { return 0 }
+func (p rawPacket) Bytes() []byte   { return p }
+
+// startBlocked starts a transfer from another client of the server at
+// saddr, waiting for its handler to start
+func startBlocked(t *testing.T, saddr net.Addr, started chan *server.Request) {
+	other := newPeer(t)
+	other.send(&pkt.ReqPacket{Type: pkt.RRQ, Filename: "other", Mode: pkt.ModeOctet}, saddr)
+	<-started
+}
+
+func TestErrorReplies(t *testing.T) {
+	block := make([]byte, 512)
+	readFile := func(err error) server.ReaderFunc {
+		return func(string) (io.Reader, error) { return nil, err }
+	}
+	writeFile := func(err error) server.WriterFunc {
+		return func(string) (io.Writer, error) { return nil, err }
+	}
+	rrq := func(name, mode string) *pkt.ReqPacket {
+		return &pkt.ReqPacket{Type: pkt.RRQ, Filename: name, Mode: mode}
+	}
+	wrq := func(name string) *pkt.ReqPacket {
+		return &pkt.ReqPacket{Type: pkt.WRQ, Filename: name, Mode: pkt.ModeOctet}
+	}
+	bigWrq := wrq("file")
+	bigWrq.Options.Set(pkt.OptTransferSize, "1000")
+
+	busy, busyStarted, _ := blockingServer()
+	busy.MaxSessionsPerIP = 1
+	draining, drainingStarted, _ := blockingServer()
+	draining.SinglePort = true
+	pending, pendingStarted, _ := blockingServer()
+	pending.MaxSessions = 1
+	pending.MaxPending = 1
+	closing := server.NewServer("", readFile(nil), nil)
+	closing.ListenTransfer = func() (net.PacketConn, error) {
+		// Closed between the start of the transfer and its socket
+		// being tracked
+		closing.Close()
+		return net.ListenPacket("udp", "127.0.0.1:0")
+	}
+
+	tests := []struct {
+		name   string
+		server *server.Server
+		// setup, if set, runs once the server at saddr is started
+		setup func(t *testing.T, s *server.Server, saddr net.Addr)
+		// packets are the request and the answers to each reply of
+		// the server, one of which it must answer with err
+		packets []pkt.Packet
+		err     *pkt.ErrorPacket
+	}{
+		{
+			name:    "truncated request",
+			server:  &server.Server{},
+			packets: []pkt.Packet{rawPacket("\x00\x01file\x00")},
+			err:     &pkt.ErrorPacket{Code: pkt.TFTPErrIllegalOp, Value: pkt.ErrTruncated.Error()},
+		},
+		{
+			name:    "duplicate option",
+			server:  &server.Server{},
+			packets: []pkt.Packet{rawPacket("\x00\x01file\x00octet\x00blksize\x00512\x00BLKSIZE\x001024\x00")},
+			err:     &pkt.ErrorPacket{Code: pkt.TFTPErrIllegalOp, Value: pkt.ErrDuplicateOption.Error()},
+		},
+		{
+			name:    "bad option",
+			server:  &server.Server{},
+			packets: []pkt.Packet{rawPacket("\x00\x02file\x00octet\x00blksize\x00")},
+			err:     &pkt.ErrorPacket{Code: pkt.TFTPErrIllegalOp, Value: pkt.ErrBadOption.Error()},
+		},
+		{
+			name:   "busy",
+			server: busy,
+			setup: func(t *testing.T, s *server.Server, saddr net.Addr) {
+				startBlocked(t, saddr, busyStarted)
+			},
+			packets: []pkt.Packet{rrq("file", pkt.ModeOctet)},
+			err:     &pkt.ErrorPacket{Code: pkt.TFTPErrUndefined, Value: server.ErrBusy.Error()},
+		},
+		{
+			name:   "request while shutting down",
+			server: draining,
+			setup: func(t *testing.T, s *server.Server, saddr net.Addr) {
+				// The listener stays open for the running transfer
+				startBlocked(t, saddr, drainingStarted)
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				s.Shutdown(ctx)
+			},
+			packets: []pkt.Packet{rrq("file", pkt.ModeOctet)},
+			err:     &pkt.ErrorPacket{Code: pkt.TFTPErrUndefined, Value: "server shutting down"},
+		},
+		{
+			name:   "pending request closed",
+			server: pending,
+			setup: func(t *testing.T, s *server.Server, saddr net.Addr) {
+				startBlocked(t, saddr, pendingStarted)
+				go func() {
+					for s.Stats().Pending == 0 {
+						time.Sleep(10 * time.Millisecond)
+					}
+					s.Close()
+				}()
+			},
+			packets: []pkt.Packet{rrq("file", pkt.ModeOctet)},
+			err:     &pkt.ErrorPacket{Code: pkt.TFTPErrUndefined, Value: "server shutting down"},
+		},
+		{
+			name:    "transfer closed before it starts",
+			server:  closing,
+			packets: []pkt.Packet{rrq("file", pkt.ModeOctet)},
+			err:     &pkt.ErrorPacket{Code: pkt.TFTPErrUndefined, Value: "server shutting down"},
+		},
+		{
+			name:    "missing file",
+			server:  server.NewServer("", readFile(&fs.PathError{Op: "open", Path: "/srv/file", Err: fs.ErrNotExist}), nil),
+			packets: []pkt.Packet{rrq("file", pkt.ModeOctet)},
+			err:     &pkt.ErrorPacket{Code: pkt.TFTPErrNotFound, Value: "file not found"},
+		},
+		{
+			name:    "permission denied",
+			server:  server.NewServer("", readFile(fs.ErrPermission), nil),
+			packets: []pkt.Packet{rrq("file", pkt.ModeOctet)},
+			err:     &pkt.ErrorPacket{Code: pkt.TFTPErrAccessViolation, Value: "access violation"},
+		},
+		{
+			name:    "no reads",
+			server:  server.NewServer("", nil, nil),
+			packets: []pkt.Packet{rrq("file", pkt.ModeOctet)},
+			err:     &pkt.ErrorPacket{Code: pkt.TFTPErrAccessViolation, Value: "access violation"},
+		},
+		{
+			name:    "unsupported mode",
+			server:  server.NewServer("", readFile(nil), nil),
+			packets: []pkt.Packet{rrq("file", "mail")},
+			err:     &pkt.ErrorPacket{Code: pkt.TFTPErrIllegalOp, Value: "unsupported transfer mode: mail"},
+		},
+		{
+			name:    "filename outside of root",
+			server:  server.NewServer("", readFile(nil), nil),
+			packets: []pkt.Packet{rrq("../secret", pkt.ModeOctet)},
+			err:     &pkt.ErrorPacket{Code: pkt.TFTPErrAccessViolation, Value: server.ErrBadFilename.Error()},
+		},
+		{
+			name: "read fails part way",
+			server: server.NewServer("", func(string) (io.Reader, error) {
+				return io.MultiReader(bytes.NewReader(block), iotest.ErrReader(errors.New("disk on fire"))), nil
+			}, nil),
+			packets: []pkt.Packet{rrq("file", pkt.ModeOctet), pkt.NewAck(1)},
+			err:     &pkt.ErrorPacket{Code: pkt.TFTPErrUndefined, Value: "disk on fire"},
+		},
+		{
+			name:    "read only",
+			server:  &server.Server{ReadOnly: true},
+			packets: []pkt.Packet{wrq("file")},
+			err:     &pkt.ErrorPacket{Code: pkt.TFTPErrAccessViolation, Value: "writing disallowed"},
+		},
+		{
+			name:    "file exists",
+			server:  server.NewServer("", nil, writeFile(fs.ErrExist)),
+			packets: []pkt.Packet{wrq("file")},
+			err:     &pkt.ErrorPacket{Code: pkt.TFTPErrAlreadyExists, Value: "file already exists"},
+		},
+		{
+			name:    "upload too large",
+			server:  &server.Server{MaxWriteSize: 100},
+			packets: []pkt.Packet{bigWrq},
+			err:     &pkt.ErrorPacket{Code: pkt.TFTPErrDiskFull, Value: "file exceeds maximum upload size"},
+		},
+		{
+			name: "write fails part way",
+			server: server.NewServer("", nil, func(string) (io.Writer, error) {
+				return failWriter{}, nil
+			}),
+			packets: []pkt.Packet{
+				wrq("file"),
+				&pkt.DataPacket{BlockNum: 1, Data: block},
+				&pkt.DataPacket{BlockNum: 2, Data: block},
+			},
+			err: &pkt.ErrorPacket{Code: pkt.TFTPErrUndefined, Value: "disk on fire"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saddr, err := net.ResolveUDPAddr("udp", startServer(t, tt.server))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.setup != nil {
+				tt.setup(t, tt.server, saddr)
+			}
+			client := newPeer(t)
+
+			to := net.Addr(saddr)
+			for _, p := range tt.packets {
+				client.send(p, to)
+				reply, from := client.recv()
+				to = from
+				errp, ok := reply.(*pkt.ErrorPacket)
+				if !ok {
+					continue
+				}
+				if errp.Code != tt.err.Code || errp.Value != tt.err.Value {
+					t.Fatalf("expected %v, got %v", tt.err, errp)
+				}
+				return
+			}
+			t.Fatalf("expected %v, got no error", tt.err)
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	pkt "github.com/whyrusleeping/go-tftp/packet"
+)
+
+// flightTable tracks the requests being served by the address of the
+// client, the type of request and the filename requested, so that
+// retransmits of a request do not start another transfer of the same
+// file.
+type flightTable struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a request being served
+type flight struct {
+	key string
+
+	mu sync.Mutex
+	// con and reply are the socket of the transfer and the first
+	// packet sent on it, once there is one
+	con   *transferConn
+	reply []byte
+}
+
+func flightKey(addr net.Addr, req *pkt.ReqPacket) string {
+	return fmt.Sprintf("%s\x00%d\x00%s", addr, req.Type, req.Filename)
+}
+
+// start registers a request from addr, returning nil if the same file
+// is already being served to addr
+func (t *flightTable) start(addr net.Addr, req *pkt.ReqPacket) *flight {
+	key := flightKey(addr, req)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if f, ok := t.flights[key]; ok {
+		// The client missed our reply, let it have another
+		f.resend()
+		return nil
+	}
+	if t.flights == nil {
+		t.flights = make(map[string]*flight)
+	}
+	f := &flight{key: key}
+	t.flights[key] = f
+	return f
+}
+
+// end removes f, letting the client request the file again
+func (t *flightTable) end(f *flight) {
+	t.mu.Lock()
+	if t.flights[f.key] == f {
+		delete(t.flights, f.key)
+	}
+	t.mu.Unlock()
+}
+
+// answered records the first packet sent for the request
+func (f *flight) answered(con *transferConn, b []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.reply == nil {
+		f.con = con
+		f.reply = append([]byte(nil), b...)
+	}
+}
+
+// resend sends the first packet for the request again, if the
+// transfer got that far
+func (f *flight) resend() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.reply != nil {
+		f.con.WriteTo(f.reply, f.con.peer)
+	}
+}
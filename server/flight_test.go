@@ -0,0 +1,98 @@
+package server_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pkt "github.com/whyrusleeping/go-tftp/packet"
+	"github.com/whyrusleeping/go-tftp/server"
+)
+
+func TestDuplicateRequest(t *testing.T) {
+	var calls int32
+	uploads := make(chan []byte, 1)
+	s := &server.Server{
+		Handler: server.HandlerFunc(func(rw server.ResponseWriter, r *server.Request) {
+			atomic.AddInt32(&calls, 1)
+			if r.Type == pkt.WRQ {
+				b, _ := io.ReadAll(r.Body)
+				uploads <- b
+				return
+			}
+			rw.Write([]byte("once"))
+		}),
+		// Any duplicate reply comes from folding, not from retransmits
+		Config: server.Config{RetransmitTime: 5 * time.Second},
+	}
+	addr := startServer(t, s)
+	saddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 1024)
+	read := func() (pkt.Packet, net.Addr) {
+		t.Helper()
+		// Well before the server would retransmit by itself
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := pkt.ParsePacket(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p, from
+	}
+
+	for _, typ := range []uint16{pkt.RRQ, pkt.WRQ} {
+		atomic.StoreInt32(&calls, 0)
+		req := &pkt.ReqPacket{Type: typ, Filename: "file", Mode: pkt.ModeOctet}
+		expect := pkt.Packet(&pkt.DataPacket{BlockNum: 1, Data: []byte("once")})
+		if typ == pkt.WRQ {
+			req.Filename = "upload"
+			expect = pkt.NewAck(0)
+		}
+
+		// Each retransmit of the request gets the first reply again,
+		// from the same transfer
+		var port net.Addr
+		for i := 0; i < 3; i++ {
+			conn.WriteTo(req.Bytes(), saddr)
+			p, from := read()
+			if !bytes.Equal(p.Bytes(), expect.Bytes()) {
+				t.Fatalf("expected %v, got %v", expect, p)
+			}
+			if port != nil && from.String() != port.String() {
+				t.Fatalf("reply from %s, expected %s", from, port)
+			}
+			port = from
+		}
+
+		if typ == pkt.RRQ {
+			conn.WriteTo(pkt.NewAck(1).Bytes(), port)
+		} else {
+			data := &pkt.DataPacket{BlockNum: 1, Data: []byte("uploaded")}
+			conn.WriteTo(data.Bytes(), port)
+			if p, _ := read(); !bytes.Equal(p.Bytes(), pkt.NewAck(1).Bytes()) {
+				t.Fatalf("expected ACK(1), got %v", p)
+			}
+			if b := <-uploads; string(b) != "uploaded" {
+				t.Fatalf("server got %q", b)
+			}
+		}
+		if n := atomic.LoadInt32(&calls); n != 1 {
+			t.Fatalf("handler called %d times", n)
+		}
+	}
+}
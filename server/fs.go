@@ -0,0 +1,156 @@
+package server
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	pkt "github.com/whyrusleeping/go-tftp/packet"
+)
+
+// CreateFS is a file system that files can also be created in.
+// FileServer accepts write requests for file systems implementing it.
+type CreateFS interface {
+	fs.FS
+
+	// Create creates or truncates the named file, as os.Create does.
+	// The name follows the same rules as for Open. If the file is
+	// also an Aborter, it is aborted rather than closed when the
+	// upload fails. Otherwise it is closed, keeping the partial
+	// upload.
+	Create(name string) (io.WriteCloser, error)
+}
+
+// DirFS returns a CreateFS for the tree of files rooted at dir. Unlike
+// os.DirFS symbolic links may only lead to files within dir, see
+// NewDirFS for other policies. Files of failed uploads are removed.
+func DirFS(dir string) CreateFS {
+	return NewDirFS(dir, SymlinksWithinRoot)
+}
+
+// NewDirFS returns a CreateFS for the tree of files rooted at dir,
+// treating symbolic links according to symlinks.
+func NewDirFS(dir string, symlinks SymlinkPolicy) CreateFS {
+	return &dirFS{dir: dir, symlinks: symlinks}
+}
+
+type dirFS struct {
+	dir      string
+	symlinks SymlinkPolicy
+}
+
+// check validates name before it is opened with op
+func (d *dirFS) check(op, name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	err := checkSymlinks(d.dir, name, d.symlinks)
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
+
+func (d *dirFS) Open(name string) (fs.File, error) {
+	err := d.check("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.DirFS(d.dir).Open(name)
+}
+
+func (d *dirFS) Create(name string) (io.WriteCloser, error) {
+	err := d.check("create", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(filepath.Join(d.dir, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, err
+	}
+	return &upload{f}, nil
+}
+
+// upload is a file created in a dirFS
+type upload struct {
+	*os.File
+}
+
+// Abort closes and removes the partial file of a failed upload
+func (u *upload) Abort() error {
+	u.File.Close()
+	return os.Remove(u.Name())
+}
+
+// FileServer returns a Handler serving the files in fsys, such as an
+// os.DirFS, embed.FS or fstest.MapFS. Write requests are accepted if
+// fsys is a CreateFS, and refused otherwise.
+func FileServer(fsys fs.FS) Handler {
+	return &fileHandler{fsys}
+}
+
+// NewFSServer returns a new tftp Server instance that will serve
+// the files in fsys, see FileServer.
+func NewFSServer(fsys fs.FS) *Server {
+	return &Server{
+		Handler: FileServer(fsys),
+	}
+}
+
+type fileHandler struct {
+	fsys fs.FS
+}
+
+func (h *fileHandler) ServeTFTP(w ResponseWriter, r *Request) {
+	// File systems take unrooted, slash separated paths
+	name := strings.TrimLeft(r.Filename, "/")
+	if !fs.ValidPath(name) {
+		w.WriteError(pkt.ErrAccessViolation)
+		return
+	}
+
+	switch r.Type {
+	case pkt.RRQ:
+		f, err := h.fsys.Open(name)
+		if err != nil {
+			w.WriteError(err)
+			return
+		}
+		defer f.Close()
+
+		fi, err := f.Stat()
+		if err != nil {
+			w.WriteError(err)
+			return
+		}
+		if !fi.Mode().IsRegular() {
+			w.WriteError(pkt.ErrNotFound)
+			return
+		}
+		w.SetSize(fi.Size())
+
+		_, err = io.Copy(w, f)
+		if err != nil {
+			w.WriteError(err)
+		}
+	case pkt.WRQ:
+		cfs, ok := h.fsys.(CreateFS)
+		if !ok {
+			w.WriteError(pkt.ErrAccessViolation)
+			return
+		}
+		f, err := cfs.Create(name)
+		if err != nil {
+			w.WriteError(err)
+			return
+		}
+
+		_, err = io.Copy(f, r.Body)
+		err = finishUpload(f, err)
+		if err != nil {
+			w.WriteError(err)
+		}
+	}
+}
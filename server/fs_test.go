@@ -0,0 +1,82 @@
+package server_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"testing/fstest"
+
+	"github.com/whyrusleeping/go-tftp/client"
+	pkt "github.com/whyrusleeping/go-tftp/packet"
+	"github.com/whyrusleeping/go-tftp/server"
+)
+
+func TestFileServer(t *testing.T) {
+	image := bytes.Repeat([]byte("boot image "), 1000)
+	fsys := fstest.MapFS{
+		"pxelinux.cfg/default": {Data: []byte("default linux\n")},
+		"images/vmlinuz":       {Data: image},
+	}
+	addr := startServer(t, server.NewFSServer(fsys))
+
+	cli, err := client.NewTftpClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	// PXE clients often ask for rooted paths
+	out := new(bytes.Buffer)
+	_, err = cli.GetFile("/images/vmlinuz", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), image) {
+		t.Fatal("Data mismatch!")
+	}
+	if cli.TransferSize != int64(len(image)) {
+		t.Fatalf("Wrong transfer size %d", cli.TransferSize)
+	}
+
+	_, err = cli.GetFile("missing", nil)
+	if !errors.Is(err, pkt.ErrNotFound) {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+
+	_, err = cli.GetFile("images", nil)
+	if !errors.Is(err, pkt.ErrNotFound) {
+		t.Fatalf("Expected not found error for a directory, got %v", err)
+	}
+
+	// A MapFS is not writable
+	_, err = cli.PutFile("upload", bytes.NewReader(image))
+	if !errors.Is(err, pkt.ErrAccessViolation) {
+		t.Fatalf("Expected access violation, got %v", err)
+	}
+}
+
+func TestDirFS(t *testing.T) {
+	dir := t.TempDir()
+	addr := startServer(t, server.NewFSServer(server.DirFS(dir)))
+
+	cli, err := client.NewTftpClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	data := bytes.Repeat([]byte("uploaded "), 1000)
+	_, err = cli.PutFile("upload", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := new(bytes.Buffer)
+	_, err = cli.GetFile("upload", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("Data mismatch!")
+	}
+}
@@ -0,0 +1,333 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+
+	"github.com/whyrusleeping/go-tftp/internal/size"
+	pkt "github.com/whyrusleeping/go-tftp/packet"
+)
+
+// Request is a read or write request received by the server.
+type Request struct {
+	// Type is pkt.RRQ or pkt.WRQ
+	Type uint16
+	// Addr is the address of the client
+	Addr net.Addr
+	// Filename is the name of the requested file, cleaned up by
+	// ResolveFilename into a path relative to the served directory
+	Filename string
+	// Mode is the transfer mode, pkt.ModeOctet or pkt.ModeNetascii.
+	// Data is translated from netascii by the server, handlers only
+	// ever see the plain file.
+	Mode string
+	// Options are the options sent with the request
+	Options pkt.Options
+
+	// Body is the file being uploaded by a write request, nil for
+	// reads. Reading from it drives the transfer.
+	Body io.Reader
+
+	ctx context.Context
+}
+
+// Context returns the context of the request. It is canceled when the
+// transfer fails or is aborted by Server.Close, and once the handler
+// has returned.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// ResponseWriter is used by a Handler to answer a request.
+type ResponseWriter interface {
+	// Write sends file data to the client of a read request. The
+	// transfer advances as the client acknowledges the data, so
+	// Write blocks until most of it has been received. On a write
+	// request it fails with ErrWriteOnWriteRequest.
+	Write(p []byte) (int, error)
+
+	// SetSize announces the size of the file being read, which is
+	// reported to clients that ask for it with the tsize option. It
+	// has no effect after the first Write.
+	SetSize(size int64)
+
+	// WriteError aborts the transfer, sending the client the TFTP
+	// error for err as made by pkt.NewErrorPacket.
+	WriteError(err error)
+}
+
+// A Handler responds to TFTP requests.
+//
+// For a read request ServeTFTP writes the file to w, and the transfer
+// is complete once it returns. For a write request it reads the upload
+// from r.Body; if it returns before reading all of it the rest is read
+// and discarded. Either way calling w.WriteError aborts the transfer.
+type Handler interface {
+	ServeTFTP(w ResponseWriter, r *Request)
+}
+
+// HandlerFunc is an adapter to use an ordinary function as a Handler.
+type HandlerFunc func(w ResponseWriter, r *Request)
+
+// ServeTFTP calls f(w, r)
+func (f HandlerFunc) ServeTFTP(w ResponseWriter, r *Request) {
+	f(w, r)
+}
+
+// FuncHandler returns a Handler that opens files with a ReaderFunc and
+// WriterFunc pair, passing them the requested filename joined to dir.
+// Symbolic links under dir may only lead to files within it, as with
+// SymlinksWithinRoot. Readers and writers that are also io.Closers are
+// closed once the transfer is done, writers that are Aborters are
+// aborted instead if the upload fails. An *os.File opened at the path
+// given to the WriterFunc is removed if the upload fails. Either
+// function may be nil to refuse that kind of request.
+func FuncHandler(dir string, rf ReaderFunc, wf WriterFunc) Handler {
+	return &funcHandler{
+		dir:       dir,
+		readFunc:  rf,
+		writeFunc: wf,
+	}
+}
+
+type funcHandler struct {
+	dir       string
+	readFunc  ReaderFunc
+	writeFunc WriterFunc
+	symlinks  SymlinkPolicy
+}
+
+func (h *funcHandler) ServeTFTP(w ResponseWriter, r *Request) {
+	if !fs.ValidPath(r.Filename) {
+		w.WriteError(pkt.ErrAccessViolation)
+		return
+	}
+	err := checkSymlinks(h.dir, r.Filename, h.symlinks)
+	if err != nil {
+		w.WriteError(err)
+		return
+	}
+	path := filepath.Join(h.dir, filepath.FromSlash(r.Filename))
+
+	switch r.Type {
+	case pkt.RRQ:
+		if h.readFunc == nil {
+			w.WriteError(pkt.ErrAccessViolation)
+			return
+		}
+		fi, err := h.readFunc(path)
+		if err != nil {
+			w.WriteError(err)
+			return
+		}
+		if c, ok := fi.(io.Closer); ok {
+			defer c.Close()
+		}
+
+		if n := size.Of(fi); n >= 0 {
+			w.SetSize(n)
+		}
+		_, err = io.Copy(w, fi)
+		if err != nil {
+			w.WriteError(err)
+		}
+	case pkt.WRQ:
+		if h.writeFunc == nil {
+			w.WriteError(pkt.ErrAccessViolation)
+			return
+		}
+		fi, err := h.writeFunc(path)
+		if err != nil {
+			w.WriteError(err)
+			return
+		}
+		if f, ok := fi.(*os.File); ok && f.Name() == path {
+			// The file made for the upload, which goes again if
+			// the upload fails
+			fi = &upload{f}
+		}
+
+		_, err = io.Copy(fi, r.Body)
+		err = finishUpload(fi, err)
+		if err != nil {
+			w.WriteError(err)
+		}
+	}
+}
+
+// An Aborter is the destination of an upload that can discard what was
+// written so far. FuncHandler and FileServer call Abort in place of
+// Close when the upload fails, so no partial file is left behind.
+// Writers that are not Aborters are closed even when the upload fails,
+// committing whatever was written.
+type Aborter interface {
+	Abort() error
+}
+
+// finishUpload closes the destination w of an upload copied with the
+// result err, or aborts it if the copy failed
+func finishUpload(w io.Writer, err error) error {
+	if a, ok := w.(Aborter); ok && err != nil {
+		a.Abort()
+		return err
+	}
+	if c, ok := w.(io.Closer); ok {
+		cerr := c.Close()
+		if err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// ErrWriteOnWriteRequest is returned by the Write method of the
+// ResponseWriter of a write request, whose data is read from the
+// Request Body.
+var ErrWriteOnWriteRequest = errors.New("Write called on a write request")
+
+// errHandlerPanic is sent to clients when a handler panics
+var errHandlerPanic = errors.New("internal server error")
+
+// response connects a running Handler to the transfer serving its
+// request. File data is passed through a pipe, from the handler to the
+// transfer for reads and the other way around for writes, so the
+// transfer can keep pulling blocks at its own pace.
+type response struct {
+	req *Request
+	pr  *io.PipeReader
+	pw  *io.PipeWriter
+
+	// ready is closed once the handler has decided how to answer,
+	// by writing, reading, failing or returning
+	ready     chan struct{}
+	readyOnce sync.Once
+	// done is closed when the handler has returned
+	done chan struct{}
+
+	mu   sync.Mutex
+	size int64
+	err  error
+}
+
+func newResponse(req *Request) *response {
+	pr, pw := io.Pipe()
+	w := &response{
+		req:   req,
+		pr:    pr,
+		pw:    pw,
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+		size:  -1,
+	}
+	if req.Type == pkt.WRQ {
+		req.Body = &requestBody{w}
+	}
+	return w
+}
+
+// start runs the handler in its own goroutine
+func (w *response) start(h Handler) {
+	go func() {
+		defer close(w.done)
+		defer w.signal()
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("panic serving %s: %v\n%s", w.req.Filename, r, debug.Stack())
+				w.WriteError(errHandlerPanic)
+			}
+		}()
+
+		h.ServeTFTP(w, w.req)
+
+		if w.req.Type == pkt.RRQ {
+			w.pw.Close()
+			return
+		}
+		if w.error() == nil {
+			// Let the upload complete even if the handler
+			// did not want all of it, or any
+			w.signal()
+			_, err := io.Copy(io.Discard, w.pr)
+			if err != nil {
+				w.WriteError(err)
+			}
+		}
+		w.pr.Close()
+	}()
+}
+
+func (w *response) signal() {
+	w.readyOnce.Do(func() {
+		close(w.ready)
+	})
+}
+
+func (w *response) Write(p []byte) (int, error) {
+	if w.req.Type != pkt.RRQ {
+		return 0, ErrWriteOnWriteRequest
+	}
+	w.signal()
+	return w.pw.Write(p)
+}
+
+func (w *response) SetSize(size int64) {
+	w.mu.Lock()
+	w.size = size
+	w.mu.Unlock()
+	w.signal()
+}
+
+func (w *response) WriteError(err error) {
+	w.mu.Lock()
+	if w.err == nil {
+		w.err = err
+	}
+	w.mu.Unlock()
+	w.signal()
+
+	if w.req.Type == pkt.RRQ {
+		w.pw.CloseWithError(err)
+	} else {
+		w.pr.CloseWithError(err)
+	}
+}
+
+// error returns the error the handler failed with, if any
+func (w *response) error() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+func (w *response) getSize() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
+// abort stops the handler after the transfer failed with err
+func (w *response) abort(err error) {
+	w.pr.CloseWithError(err)
+	w.pw.CloseWithError(err)
+}
+
+// requestBody is the Body of a write request
+type requestBody struct {
+	w *response
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	b.w.signal()
+	return b.w.pr.Read(p)
+}
@@ -0,0 +1,117 @@
+package server_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/whyrusleeping/go-tftp/client"
+	pkt "github.com/whyrusleeping/go-tftp/packet"
+	"github.com/whyrusleeping/go-tftp/server"
+)
+
+func TestHandlerFunc(t *testing.T) {
+	s := &server.Server{
+		Handler: server.HandlerFunc(func(w server.ResponseWriter, r *server.Request) {
+			for i := 0; i < 100; i++ {
+				fmt.Fprintf(w, "%s line %d\n", r.Filename, i)
+			}
+		}),
+	}
+	cli, err := client.NewTftpClient(startServer(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	out := new(bytes.Buffer)
+	if _, err := cli.GetFile("generated", out); err != nil {
+		t.Fatal(err)
+	}
+	want := new(strings.Builder)
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(want, "generated line %d\n", i)
+	}
+	if out.String() != want.String() {
+		t.Fatalf("got %q", out)
+	}
+}
+
+func TestHandlerSetSize(t *testing.T) {
+	s := &server.Server{
+		Handler: server.HandlerFunc(func(w server.ResponseWriter, r *server.Request) {
+			w.SetSize(1234)
+			w.Write(make([]byte, 1234))
+		}),
+	}
+	peer, saddr := startPeer(t, s)
+	req := &pkt.ReqPacket{Type: pkt.RRQ, Filename: "file", Mode: pkt.ModeOctet}
+	req.Options.Set(pkt.OptTransferSize, "0")
+	oack, reply, port := peer.request(req, saddr)
+	defer peer.send(&pkt.ErrorPacket{Code: pkt.TFTPErrUndefined, Value: "done"}, port)
+	if oack == nil {
+		t.Fatalf("expected OACK, got %v", reply)
+	}
+	if v, _ := oack.Options.Get(pkt.OptTransferSize); v != "1234" {
+		t.Fatalf("OACK tsize %q", v)
+	}
+}
+
+func TestHandlerWriteError(t *testing.T) {
+	s := &server.Server{
+		Handler: server.HandlerFunc(func(w server.ResponseWriter, r *server.Request) {
+			w.WriteError(pkt.ErrNotFound)
+			// Too late, the transfer is over
+			w.Write([]byte("data"))
+		}),
+	}
+	peer, saddr := startPeer(t, s)
+	_, reply, _ := peer.request(&pkt.ReqPacket{Type: pkt.RRQ, Filename: "file", Mode: pkt.ModeOctet}, saddr)
+	errPkt, ok := reply.(*pkt.ErrorPacket)
+	if !ok || errPkt.Code != pkt.TFTPErrNotFound {
+		t.Fatalf("expected file not found error, got %v", reply)
+	}
+}
+
+func TestHandlerNoWrite(t *testing.T) {
+	writeErr := make(chan error, 1)
+	s := &server.Server{
+		Handler: server.HandlerFunc(func(w server.ResponseWriter, r *server.Request) {
+			if r.Type == pkt.WRQ {
+				// Uploads are read from the Body
+				_, err := w.Write([]byte("data"))
+				writeErr <- err
+			}
+		}),
+	}
+	cli, err := client.NewTftpClient(startServer(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	// A read without data is an empty file
+	out := new(bytes.Buffer)
+	n, err := cli.GetFile("empty", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 || out.Len() != 0 {
+		t.Fatalf("got %d bytes", n)
+	}
+
+	// A write that is not read is accepted all the same
+	data := bytes.Repeat([]byte("unread"), 1000)
+	n, err = cli.PutFile("ignored", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(data) {
+		t.Fatalf("uploaded %d bytes, expected %d", n, len(data))
+	}
+	if err := <-writeErr; !errors.Is(err, server.ErrWriteOnWriteRequest) {
+		t.Fatalf("Write on a write request returned %v", err)
+	}
+}
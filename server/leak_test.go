@@ -0,0 +1,64 @@
+package server_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"testing"
+	"time"
+
+	pkt "github.com/whyrusleeping/go-tftp/packet"
+	"github.com/whyrusleeping/go-tftp/server"
+)
+
+func TestTimeoutNoLeak(t *testing.T) {
+	s := server.NewServer("",
+		func(string) (io.Reader, error) {
+			return bytes.NewReader(make([]byte, 100000)), nil
+		},
+		func(string) (io.Writer, error) {
+			return io.Discard, nil
+		})
+	s.Retries = 2
+	addr := startServer(t, s)
+	saddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := runtime.NumGoroutine()
+
+	// Clients that vanish right after their request, with and without
+	// windows
+	for _, typ := range []uint16{pkt.RRQ, pkt.WRQ} {
+		for _, windowsize := range []string{"1", "8"} {
+			req := &pkt.ReqPacket{Type: typ, Filename: "file", Mode: pkt.ModeOctet}
+			req.Options.Set(pkt.OptUTimeout, "10000")
+			req.Options.Set(pkt.OptWindowSize, windowsize)
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.WriteTo(req.Bytes(), saddr)
+		}
+	}
+	waitStats(t, s, func(st server.Stats) bool { return st.Running == 4 })
+
+	deadline := time.Now().Add(time.Minute)
+	for {
+		st := s.Stats()
+		n := runtime.NumGoroutine()
+		if st.Running == 0 && st.Pending == 0 && n <= before {
+			break
+		}
+		if time.Now().After(deadline) {
+			var stacks strings.Builder
+			pprof.Lookup("goroutine").WriteTo(&stacks, 1)
+			t.Fatalf("%d goroutines left, %d before, stats %+v:\n%s", n, before, st, stacks.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
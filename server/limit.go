@@ -0,0 +1,135 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrBusy is sent to clients whose requests are refused because the
+// server is running as many transfers as its limits allow.
+var ErrBusy = errors.New("server busy")
+
+// Stats is a snapshot of the transfers of a server.
+type Stats struct {
+	// Running is the number of transfers running
+	Running int
+	// Pending is the number of requests waiting for a transfer to
+	// end before they can start
+	Pending int
+	// PerIP is the number of requests, running or pending, from each
+	// client IP address
+	PerIP map[string]int
+	// Refused counts the requests refused with ErrBusy
+	Refused uint64
+}
+
+// limits holds the counts enforcing MaxSessions, MaxSessionsPerIP and
+// MaxPending. It is guarded by the mutex of the server.
+type limits struct {
+	running int
+	pending int
+	perIP   map[string]int
+	refused uint64
+	// freed is signalled when a transfer ends or the server is closed
+	freed *sync.Cond
+}
+
+// Stats returns the current counts of transfers and requests.
+func (s *Server) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := Stats{
+		Running: s.limits.running,
+		Pending: s.limits.pending,
+		PerIP:   make(map[string]int, len(s.limits.perIP)),
+		Refused: s.limits.refused,
+	}
+	for ip, n := range s.limits.perIP {
+		st.PerIP[ip] = n
+	}
+	return st
+}
+
+// clientIP returns the IP address of addr that MaxSessionsPerIP counts
+func clientIP(addr net.Addr) string {
+	if ua, ok := addr.(*net.UDPAddr); ok {
+		return ua.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// admit reserves a place for a request from ip in the pending queue,
+// reporting false if the server is too busy to take it
+func (s *Server) admit(ip string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := &s.limits
+	if s.MaxSessionsPerIP > 0 && l.perIP[ip] >= s.MaxSessionsPerIP {
+		l.refused++
+		return false
+	}
+	// Admitted requests count as pending until their transfer starts,
+	// so that a burst of requests cannot overfill the queue. Without
+	// MaxSessions no request waits, so there is no queue to bound.
+	if s.MaxSessions > 0 && l.running+l.pending >= s.MaxSessions+s.MaxPending {
+		l.refused++
+		return false
+	}
+	if l.perIP == nil {
+		l.perIP = make(map[string]int)
+	}
+	l.perIP[ip]++
+	l.pending++
+	return true
+}
+
+// acquire waits until the transfer of an admitted request can start,
+// reporting false if the server is closed first. Either way release
+// must be called once the request is done.
+func (s *Server) acquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := &s.limits
+	if l.freed == nil {
+		l.freed = sync.NewCond(&s.mu)
+	}
+	for s.MaxSessions > 0 && l.running >= s.MaxSessions && !s.closed {
+		l.freed.Wait()
+	}
+	l.pending--
+	if s.closed {
+		// Counted as running so that release can undo it
+		l.running++
+		return false
+	}
+	l.running++
+	return true
+}
+
+// release ends a request of ip started by acquire
+func (s *Server) release(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := &s.limits
+	l.running--
+	l.perIP[ip]--
+	if l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+	if l.freed != nil {
+		l.freed.Signal()
+	}
+}
+
+// wakePendingLocked lets the pending requests see that the server is
+// closed
+func (s *Server) wakePendingLocked() {
+	if s.limits.freed != nil {
+		s.limits.freed.Broadcast()
+	}
+}
@@ -0,0 +1,222 @@
+package server_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/whyrusleeping/go-tftp/client"
+	pkt "github.com/whyrusleeping/go-tftp/packet"
+	"github.com/whyrusleeping/go-tftp/server"
+)
+
+// waitStats polls the stats of s until ok accepts them
+func waitStats(t *testing.T, s *server.Server, ok func(server.Stats) bool) server.Stats {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st := s.Stats()
+		if ok(st) {
+			return st
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected stats %+v", st)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	s := &server.Server{
+		Handler: server.HandlerFunc(func(w server.ResponseWriter, r *server.Request) {
+			started <- struct{}{}
+			<-release
+			w.Write([]byte("finished"))
+		}),
+		MaxSessions: 2,
+		MaxPending:  1,
+	}
+	addr := startServer(t, s)
+
+	get := func() error {
+		cli, err := client.NewTftpClient(addr)
+		if err != nil {
+			return err
+		}
+		defer cli.Close()
+		_, err = cli.GetFile("file", new(bytes.Buffer))
+		return err
+	}
+
+	got := make(chan error, 3)
+	for i := 0; i < 2; i++ {
+		go func() { got <- get() }()
+		<-started
+	}
+	go func() { got <- get() }()
+	waitStats(t, s, func(st server.Stats) bool { return st.Pending == 1 })
+
+	// Both the running transfers and the queue are full
+	err := get()
+	if err == nil || !strings.Contains(err.Error(), server.ErrBusy.Error()) {
+		t.Fatalf("expected %q, got %v", server.ErrBusy, err)
+	}
+	st := s.Stats()
+	if st.Running != 2 || st.Pending != 1 || st.Refused != 1 || st.PerIP["127.0.0.1"] != 3 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		if err := <-got; err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitStats(t, s, func(st server.Stats) bool {
+		return st.Running == 0 && st.Pending == 0 && len(st.PerIP) == 0
+	})
+}
+
+func TestLimitPerIP(t *testing.T) {
+	s, started, release := blockingServer()
+	s.MaxSessionsPerIP = 1
+	addr := startServer(t, s)
+
+	cli, err := client.NewTftpClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	got := make(chan error, 1)
+	go func() {
+		_, err := cli.GetFile("file", new(bytes.Buffer))
+		got <- err
+	}()
+	<-started
+
+	other, err := client.NewTftpClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	_, err = other.GetFile("file", new(bytes.Buffer))
+	if err == nil || !strings.Contains(err.Error(), server.ErrBusy.Error()) {
+		t.Fatalf("expected %q, got %v", server.ErrBusy, err)
+	}
+
+	close(release)
+	if err := <-got; err != nil {
+		t.Fatal(err)
+	}
+	if st := s.Stats(); st.Refused != 1 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+func TestClosePending(t *testing.T) {
+	s, started, _ := blockingServer()
+	s.MaxSessions = 1
+	s.MaxPending = 1
+	addr := startServer(t, s)
+
+	got := make(chan error, 1)
+	for i := 0; i < 2; i++ {
+		cli, err := client.NewTftpClient(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		cli.Timeout = 100 * time.Millisecond
+		if i == 0 {
+			go cli.GetFile("file", new(bytes.Buffer))
+			<-started
+			continue
+		}
+		go func() {
+			_, err := cli.GetFile("file", new(bytes.Buffer))
+			got <- err
+		}()
+	}
+	waitStats(t, s, func(st server.Stats) bool { return st.Pending == 1 })
+
+	// The pending request must not wait forever for a transfer slot,
+	// and its client is told
+	s.Close()
+	waitStats(t, s, func(st server.Stats) bool { return st.Running == 0 && st.Pending == 0 })
+	if err := <-got; err == nil || err.Error() != "server shutting down" {
+		t.Fatalf("expected pending request to be refused, got %v", err)
+	}
+}
+
+// errFinished is sent by the handler of TestLimitBurst
+var errFinished = errors.New("finished")
+
+func TestLimitBurst(t *testing.T) {
+	const burst = 8
+	cases := []struct {
+		name                    string
+		maxSessions, maxPending int
+		admitted                int
+	}{
+		{"sessions and queue", 2, 1, 3},
+		// The queue only bounds requests waiting for MaxSessions
+		{"queue alone", 0, 2, burst},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			release := make(chan struct{})
+			s := &server.Server{
+				// Ends its transfer without waiting for the client
+				Handler: server.HandlerFunc(func(w server.ResponseWriter, r *server.Request) {
+					<-release
+					w.WriteError(errFinished)
+				}),
+				MaxSessions: c.maxSessions,
+				MaxPending:  c.maxPending,
+			}
+			_, saddr := startPeer(t, s)
+			admitted := c.admitted
+
+			// All requests arrive before any transfer can start
+			peers := make([]*udpPeer, burst)
+			for i := range peers {
+				peers[i] = newPeer(t)
+				peers[i].send(&pkt.ReqPacket{Type: pkt.RRQ, Filename: "file", Mode: pkt.ModeOctet}, saddr)
+			}
+			waitStats(t, s, func(st server.Stats) bool {
+				return st.Refused == uint64(burst-admitted) && st.Running+st.Pending == admitted
+			})
+
+			busy := 0
+			var waiting []*udpPeer
+			for _, p := range peers {
+				p.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+				n, _, err := p.conn.ReadFrom(p.buf)
+				if err != nil {
+					waiting = append(waiting, p)
+					continue
+				}
+				reply, _ := pkt.ParsePacket(p.buf[:n])
+				if err, ok := reply.(error); !ok || err.Error() != server.ErrBusy.Error() {
+					t.Fatalf("expected %q, got %v", server.ErrBusy, reply)
+				}
+				busy++
+			}
+			if busy != burst-admitted || len(waiting) != admitted {
+				t.Fatalf("%d requests refused, %d admitted", busy, len(waiting))
+			}
+
+			close(release)
+			for _, p := range waiting {
+				reply, _ := p.recv()
+				if err, ok := reply.(error); !ok || err.Error() != errFinished.Error() {
+					t.Fatalf("expected %q, got %v", errFinished, reply)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	pkt "github.com/whyrusleeping/go-tftp/packet"
+)
+
+// DefaultBlockSize is the block size used when none is negotiated,
+// as specified in rfc 1350
+const DefaultBlockSize = 512
+
+// maxBlockSizeLimit is the largest block size allowed by rfc 2348
+const maxBlockSizeLimit = 65464
+
+// xferOptions holds the parameters agreed upon for a single transfer
+type xferOptions struct {
+	blksize int
+	// tsize is the transfer size announced by the client on a write
+	// request, or -1 if it was not given
+	tsize int64
+	// timeout is the time to wait before retransmitting, until the
+	// round trip time is measured. minTimeout and maxTimeout bound it.
+	timeout    time.Duration
+	minTimeout time.Duration
+	maxTimeout time.Duration
+	// retries is the number of retransmits before giving up
+	retries int
+	// windowsize is the number of blocks sent before waiting for an ACK
+	windowsize int
+	// rollover is the block number that follows 65535
+	rollover uint16
+}
+
+// setTimeout applies the timeout asked for by the client, which the
+// measured round trip time may raise but not lower
+func (o *xferOptions) setTimeout(t time.Duration) {
+	o.timeout = t
+	o.minTimeout = t
+	if o.maxTimeout < t {
+		o.maxTimeout = t
+	}
+}
+
+func (s *Server) minBlockSize() int {
+	if s.MinBlockSize > 0 {
+		return s.MinBlockSize
+	}
+	return 8
+}
+
+func (s *Server) maxWindowSize() int {
+	if s.MaxWindowSize > 0 {
+		return s.MaxWindowSize
+	}
+	return 64
+}
+
+func (s *Server) maxBlockSize() int {
+	if s.MaxBlockSize > maxBlockSizeLimit {
+		return maxBlockSizeLimit
+	}
+	if s.MaxBlockSize > 0 {
+		return s.MaxBlockSize
+	}
+	return TftpMaxPacketSize
+}
+
+// negotiate works out the options to use for the given request. It
+// returns the OACK to send, or nil if no requested option was accepted,
+// in which case the transfer proceeds as plain rfc 1350. size is the
+// size of the file being read, or -1 if it is unknown.
+func (s *Server) negotiate(req *pkt.ReqPacket, size int64) (*xferOptions, *pkt.OAckPacket) {
+	opts := &xferOptions{
+		blksize:    DefaultBlockSize,
+		tsize:      -1,
+		timeout:    s.retransmitTime(),
+		minTimeout: s.minTimeout(),
+		maxTimeout: s.maxTimeout(),
+		retries:    s.retries(),
+		windowsize: 1,
+	}
+	oack := pkt.NewOAckPacket()
+	for _, o := range req.Options {
+		switch strings.ToLower(o.Name) {
+		case pkt.OptBlockSize:
+			bs, err := strconv.Atoi(o.Value)
+			if err != nil || bs < s.minBlockSize() {
+				// Unacceptable options are left out of the OACK,
+				// and the transfer falls back to the default
+				continue
+			}
+			if bs > s.maxBlockSize() {
+				bs = s.maxBlockSize()
+			}
+			opts.blksize = bs
+			oack.Options.Set(pkt.OptBlockSize, fmt.Sprint(bs))
+		case pkt.OptTransferSize:
+			ts, err := strconv.ParseInt(o.Value, 10, 64)
+			if err != nil || ts < 0 {
+				continue
+			}
+			if req.Type == pkt.WRQ {
+				// rfc 2349: the client tells us the size of the upload,
+				// and we echo it back
+				opts.tsize = ts
+				oack.Options.Set(pkt.OptTransferSize, o.Value)
+			} else if size >= 0 {
+				oack.Options.Set(pkt.OptTransferSize, fmt.Sprint(size))
+			}
+		case pkt.OptTimeout:
+			// rfc 2349 allows 1 to 255 seconds
+			t, err := strconv.Atoi(o.Value)
+			if err != nil || t < 1 || t > 255 {
+				continue
+			}
+			opts.setTimeout(time.Duration(t) * time.Second)
+			oack.Options.Set(pkt.OptTimeout, o.Value)
+		case pkt.OptUTimeout:
+			// Same bounds as tftp-hpa, 10ms to 255 seconds
+			t, err := strconv.Atoi(o.Value)
+			if err != nil || t < 10000 || t > 255000000 {
+				continue
+			}
+			opts.setTimeout(time.Duration(t) * time.Microsecond)
+			oack.Options.Set(pkt.OptUTimeout, o.Value)
+		case pkt.OptWindowSize:
+			// rfc 7440 allows 1 to 65535 blocks, we may reply
+			// with any smaller value
+			ws, err := strconv.Atoi(o.Value)
+			if err != nil || ws < 1 || ws > 65535 {
+				continue
+			}
+			if ws > s.maxWindowSize() {
+				ws = s.maxWindowSize()
+			}
+			opts.windowsize = ws
+			oack.Options.Set(pkt.OptWindowSize, fmt.Sprint(ws))
+		case pkt.OptRollover:
+			if o.Value != "0" && o.Value != "1" {
+				continue
+			}
+			opts.rollover = uint16(o.Value[0] - '0')
+			oack.Options.Set(pkt.OptRollover, o.Value)
+		}
+	}
+
+	if len(oack.Options) == 0 {
+		return opts, nil
+	}
+	return opts, oack
+}
+
+// checkMode reports whether req asks for a netascii transfer, sending
+// the client an illegal operation error if we do not support its mode
+func checkMode(req *pkt.ReqPacket, con *transferConn) (bool, error) {
+	switch strings.ToLower(req.Mode) {
+	case pkt.ModeOctet:
+		return false, nil
+	case pkt.ModeNetascii:
+		return true, nil
+	}
+
+	errPkt := pkt.ErrorPacket{}
+	errPkt.Value = "unsupported transfer mode: " + req.Mode
+	errPkt.Code = pkt.TFTPErrIllegalOp
+	_, err := con.Write(errPkt.Bytes())
+	if err != nil {
+		return false, err
+	}
+	return false, ErrBadMode
+}
@@ -0,0 +1,200 @@
+package server_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	pkt "github.com/whyrusleeping/go-tftp/packet"
+	"github.com/whyrusleeping/go-tftp/server"
+)
+
+// startPeer runs s and returns its address with a peer to talk to it
+func startPeer(t *testing.T, s *server.Server) (*udpPeer, net.Addr) {
+	saddr, err := net.ResolveUDPAddr("udp", startServer(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newPeer(t), saddr
+}
+
+// request sends req to the server at saddr, returning the OACK, or nil
+// if the server replied with anything else, along with that reply and
+// the port of the transfer
+func (p *udpPeer) request(req *pkt.ReqPacket, saddr net.Addr) (*pkt.OAckPacket, pkt.Packet, net.Addr) {
+	p.t.Helper()
+	p.send(req, saddr)
+	reply, port := p.recv()
+	oack, _ := reply.(*pkt.OAckPacket)
+	return oack, reply, port
+}
+
+func TestBlockSize(t *testing.T) {
+	data := bytes.Repeat([]byte("b"), 70000)
+	cases := []struct {
+		name    string
+		max     int
+		blksize string
+		// oack is the blksize in the OACK, or "" if there is none
+		oack  string
+		block int
+	}{
+		{"agreed", 0, "1024", "1024", 1024},
+		{"clamped", 1000, "1400", "1000", 1000},
+		{"below minimum", 0, "4", "", 512},
+		{"not a number", 0, "big", "", 512},
+		{"rfc limit", 100000, "65535", "65464", 65464},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := &server.Server{
+				Handler: server.HandlerFunc(func(w server.ResponseWriter, r *server.Request) {
+					w.Write(data)
+				}),
+				MaxBlockSize: c.max,
+			}
+			peer, saddr := startPeer(t, s)
+			req := &pkt.ReqPacket{Type: pkt.RRQ, Filename: "file", Mode: pkt.ModeOctet}
+			req.Options.Set(pkt.OptBlockSize, c.blksize)
+			oack, reply, port := peer.request(req, saddr)
+			if c.oack != "" {
+				if oack == nil {
+					t.Fatalf("expected OACK, got %v", reply)
+				}
+				if v, _ := oack.Options.Get(pkt.OptBlockSize); v != c.oack {
+					t.Fatalf("OACK blksize %q, want %q", v, c.oack)
+				}
+				peer.send(pkt.NewAck(0), port)
+				reply, _ = peer.recv()
+			}
+			d, ok := reply.(*pkt.DataPacket)
+			if !ok || d.BlockNum != 1 {
+				t.Fatalf("expected DATA(1), got %v", reply)
+			}
+			if len(d.Data) != c.block {
+				t.Fatalf("block of %d bytes, want %d", len(d.Data), c.block)
+			}
+			peer.send(&pkt.ErrorPacket{Code: pkt.TFTPErrUndefined, Value: "done"}, port)
+		})
+	}
+}
+
+func TestTransferSize(t *testing.T) {
+	data := bytes.Repeat([]byte("t"), 1000)
+	s := server.NewServer("", func(name string) (io.Reader, error) {
+		if name == "stream" {
+			// Nothing to tell the size of this one by
+			return io.MultiReader(bytes.NewReader(data)), nil
+		}
+		return bytes.NewReader(data), nil
+	}, func(string) (io.Writer, error) {
+		return io.Discard, nil
+	})
+	s.MaxWriteSize = 2000
+	_, saddr := startPeer(t, s)
+
+	cases := []struct {
+		name     string
+		typ      uint16
+		filename string
+		tsize    string
+		// oack is the tsize in the OACK, or "" if there is none
+		oack string
+		err  error
+	}{
+		{"read", pkt.RRQ, "file", "0", "1000", nil},
+		{"read unknown size", pkt.RRQ, "stream", "0", "", nil},
+		{"write", pkt.WRQ, "upload", "2000", "2000", nil},
+		{"write too large", pkt.WRQ, "upload", "2001", "", pkt.ErrDiskFull},
+		{"negative", pkt.WRQ, "upload", "-1", "", nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// A peer of its own, so the request is not taken as a
+			// retransmit of the one before
+			peer := newPeer(t)
+			req := &pkt.ReqPacket{Type: c.typ, Filename: c.filename, Mode: pkt.ModeOctet}
+			req.Options.Set(pkt.OptTransferSize, c.tsize)
+			oack, reply, port := peer.request(req, saddr)
+			defer peer.send(&pkt.ErrorPacket{Code: pkt.TFTPErrUndefined, Value: "done"}, port)
+			switch {
+			case c.err != nil:
+				if err, ok := reply.(error); !ok || !errors.Is(err, c.err) {
+					t.Fatalf("expected %v, got %v", c.err, reply)
+				}
+			case c.oack != "":
+				if oack == nil {
+					t.Fatalf("expected OACK, got %v", reply)
+				}
+				if v, _ := oack.Options.Get(pkt.OptTransferSize); v != c.oack {
+					t.Fatalf("OACK tsize %q, want %q", v, c.oack)
+				}
+			case oack != nil:
+				t.Fatalf("unexpected OACK %v", oack.Options)
+			}
+		})
+	}
+}
+
+func TestTimeoutOption(t *testing.T) {
+	cases := []struct {
+		name  string
+		opt   string
+		value string
+		// retransmit is the agreed retransmit timeout, or zero if the
+		// option is ignored
+		retransmit time.Duration
+	}{
+		{"timeout", pkt.OptTimeout, "1", time.Second},
+		{"utimeout", pkt.OptUTimeout, "100000", 100 * time.Millisecond},
+		{"timeout 0", pkt.OptTimeout, "0", 0},
+		{"timeout over 255", pkt.OptTimeout, "256", 0},
+		{"utimeout under 10ms", pkt.OptUTimeout, "9999", 0},
+		{"not a number", pkt.OptTimeout, "soon", 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := &server.Server{
+				Handler: server.HandlerFunc(func(w server.ResponseWriter, r *server.Request) {
+					w.Write([]byte("data"))
+				}),
+				// Well above the agreed timeouts
+				Config: server.Config{RetransmitTime: 3 * time.Second},
+			}
+			peer, saddr := startPeer(t, s)
+			req := &pkt.ReqPacket{Type: pkt.RRQ, Filename: "file", Mode: pkt.ModeOctet}
+			req.Options.Set(c.opt, c.value)
+			// Keeps an OACK coming when the timeout is ignored
+			req.Options.Set(pkt.OptBlockSize, "1024")
+			oack, reply, port := peer.request(req, saddr)
+			defer peer.send(&pkt.ErrorPacket{Code: pkt.TFTPErrUndefined, Value: "done"}, port)
+			if oack == nil {
+				t.Fatalf("expected OACK, got %v", reply)
+			}
+			v, ok := oack.Options.Get(c.opt)
+			if c.retransmit == 0 {
+				if ok {
+					t.Fatalf("OACK has %s %q", c.opt, v)
+				}
+				return
+			}
+			if v != c.value {
+				t.Fatalf("OACK %s %q, want %q", c.opt, v, c.value)
+			}
+
+			// The OACK is retransmitted after the agreed timeout
+			start := time.Now()
+			again, _ := peer.recvWithin(2 * time.Second)
+			elapsed := time.Since(start)
+			if _, ok := again.(*pkt.OAckPacket); !ok {
+				t.Fatalf("expected OACK retransmit, got %v", again)
+			}
+			if elapsed < c.retransmit-10*time.Millisecond || elapsed > c.retransmit*3/2+200*time.Millisecond {
+				t.Fatalf("OACK retransmitted after %v, want %v", elapsed, c.retransmit)
+			}
+		})
+	}
+}
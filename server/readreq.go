@@ -1,10 +1,10 @@
 package server
 
 import (
+	"context"
 	"io"
 	"log"
 	"net"
-	"time"
 
 	pkt "github.com/whyrusleeping/go-tftp/packet"
 )
@@ -12,117 +12,157 @@ import (
 // HandleReadReq handles a new read request with a client, sending them
 // the requested file if it exists.
 func (s *Server) HandleReadReq(rrq *pkt.ReqPacket, addr *net.UDPAddr) error {
+	return s.handleReadReq(rrq, addr, nil)
+}
+
+func (s *Server) handleReadReq(rrq *pkt.ReqPacket, addr *net.UDPAddr, f *flight) error {
 	log.Printf("Read Request: %s", rrq.Filename)
 	log.Printf("Dialing out %s", addr.String())
 
-	// 'Our' Address
-	listaddr, err := net.ResolveUDPAddr("udp", ":0")
+	// A new port of ours for the transfer
+	con, err := s.dial(addr)
 	if err != nil {
 		return err
 	}
+	defer con.Close()
+	con.flight = f
 
-	// Connection directly to their open port
-	con, err := net.DialUDP("udp", listaddr, addr)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = s.trackConn(con, cancel)
 	if err != nil {
+		sendError(con, errServerClosing)
 		return err
 	}
+	defer s.untrackConn(con)
 
-	// Open whatever file it is that the client desires,
-	// no questions asked (TODO: enforce root locking)
-	fi, err := s.ReadFunc(s.servdir + "/" + rrq.Filename)
+	netascii, err := checkMode(rrq, con)
 	if err != nil {
 		return err
 	}
 
-	buf := make([]byte, 512)
-	blknum := uint16(1)
-	var done bool
-	for len(buf) == 512 && !done {
-		n, err := fi.Read(buf)
-		if err != nil && err != io.EOF {
+	r, err := s.newRequest(ctx, rrq, addr, con)
+	if err != nil {
+		return err
+	}
+	w := newResponse(r)
+	w.start(s.handler())
+
+	err = s.sendFile(con, rrq, w, netascii)
+	if err != nil {
+		cancel()
+		w.abort(err)
+	}
+	<-w.done
+	if err != nil {
+		return err
+	}
+	log.Println("done with transfer")
+	return nil
+}
+
+// sendFile sends the client the file written by the handler behind w
+func (s *Server) sendFile(con *transferConn, rrq *pkt.ReqPacket, w *response, netascii bool) error {
+	// Wait for the handler to either start writing or fail
+	<-w.ready
+	if err := w.error(); err != nil {
+		sendError(con, err)
+		return err
+	}
+
+	var fi io.Reader = w.pr
+	size := w.getSize()
+	if netascii {
+		// The size on the wire is not known until the file is encoded
+		fi = pkt.NewNetasciiReader(fi)
+		size = -1
+	}
+
+	opts, oack := s.negotiate(rrq, size)
+	t := newTransfer(con, opts)
+	if oack != nil {
+		// The OACK is acknowledged by the client with ACK(0)
+		_, err := sendWindow(t, []pkt.Packet{oack}, 0)
+		if err != nil {
 			return err
 		}
-		if err == io.EOF {
-			done = true
-		}
+	}
 
-		buf = buf[:n]
+	// window holds the blocks that have been sent but not acknowledged,
+	// it is refilled up to the agreed window size before each send
+	var window []pkt.Packet
+	blknum := uint16(1)
+	var done bool
+	for !done || len(window) > 0 {
+		for !done && len(window) < opts.windowsize {
+			buf := make([]byte, opts.blksize)
+			n, err := io.ReadFull(fi, buf)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				// The handler failed part way through
+				sendError(con, err)
+				return err
+			}
+			if n < opts.blksize {
+				done = true
+			}
 
-		data := &pkt.DataPacket{
-			Data:     buf,
-			BlockNum: blknum,
+			window = append(window, &pkt.DataPacket{
+				Data:     buf[:n],
+				BlockNum: blknum,
+			})
+			blknum = pkt.NextBlockNum(blknum, opts.rollover)
 		}
 
-		err = sendDataPacket(data, con)
+		first := window[0].(*pkt.DataPacket).BlockNum
+		acked, err := sendWindow(t, window, first)
 		if err != nil {
 			return err
 		}
-		blknum++
+		// rfc 7440: after a partial ACK the next window starts
+		// with the block following the acknowledged one
+		window = window[acked:]
 	}
-	log.Println("done with transfer")
 	return nil
 }
 
-// sendDataPacket sends the given data packet to the connected client
-// and waits for the correct ACK, or times out
-func sendDataPacket(d *pkt.DataPacket, con *net.UDPConn) error {
-	//log.Println("Sending data!")
-	_, err := con.Write(d.Bytes())
+// sendWindow sends the given packets, numbered from first, to the
+// connected client and waits for an ACK of any of them, retransmitting
+// the whole window as needed. It returns the number of packets covered
+// by the ACK.
+func sendWindow(t *transfer, window []pkt.Packet, first uint16) (int, error) {
+	err := t.send(window...)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	// Now wait for the ACK...
-	maxtimeout := time.After(AckTimeout)
-	ackch := make(chan error)
-
-	// Move it to its own function
-	go func() {
-		ack := make([]byte, 256)
-		for {
-			n, _, err := con.ReadFromUDP(ack)
-			if err != nil {
-				ackch <- err
-				return
-			}
-
-			pack, err := pkt.ParsePacket(ack[:n])
-			if err != nil {
-				ackch <- err
-				return
-			}
-
-			// Check packet type
-			ackpack, ok := pack.(*pkt.AckPacket)
-			if !ok {
-				ackch <- pkt.ErrPacketType
-				return
-			}
+	for {
+		pack, err := t.recv()
+		if err != nil {
+			return 0, err
+		}
 
-			if ackpack.GetBlocknum() != d.BlockNum {
-				log.Printf("got ack(%d) but expected ack(%d)\n", d.BlockNum, ackpack.GetBlocknum())
-				continue
+		// Check packet type
+		ackpack, ok := pack.(*pkt.AckPacket)
+		if !ok {
+			if errpack, ok := pack.(*pkt.ErrorPacket); ok {
+				// The client gave up, ie. refused our options
+				return 0, errpack
 			}
-			ackch <- nil
-			return
+			// A retransmit of the request in single port mode,
+			// or a late packet of an earlier transfer. The
+			// window is resent when the timer runs out.
+			log.Printf("ignoring unexpected packet of type %d", pack.GetType())
+			continue
 		}
-	}()
 
-	// Loop and retransmit until ack or timeout
-	retransmit := time.After(RetransmitTime)
-	for {
-		select {
-		case <-maxtimeout:
-			return ErrTimeout
-		case <-retransmit:
-			log.Println("Retransmit")
-			_, err := con.Write(d.Bytes())
-			if err != nil {
-				return err
+		// Block numbers wrap, so look for the ACK in the block
+		// numbers of the window rather than comparing them
+		for i, blk := 0, first; i < len(window); i, blk = i+1, pkt.NextBlockNum(blk, t.opts.rollover) {
+			if ackpack.GetBlocknum() == blk {
+				t.answered()
+				return i + 1, nil
 			}
-			retransmit = time.After(RetransmitTime)
-		case err := <-ackch:
-			return err
 		}
+		log.Printf("got ack(%d) outside of window starting at %d\n", ackpack.GetBlocknum(), first)
 	}
 }
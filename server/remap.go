@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+
+	pkt "github.com/whyrusleeping/go-tftp/packet"
+)
+
+// ErrRemapDenied is returned for requests refused by a remap rule.
+var ErrRemapDenied = errors.New("access denied by remap rule")
+
+// ErrRemapLoop is returned when remap rules keep starting over.
+var ErrRemapLoop = errors.New("remap rules loop")
+
+// maxRemapPasses bounds how often the 's' flag may restart the rules
+const maxRemapPasses = 100
+
+// Remapper rewrites requested filenames with a list of rules in the
+// format of the tftpd-hpa remap file. Each line of the file holds a
+// rule made of flags, a regular expression and, for rules with the 'r'
+// flag, a replacement:
+//
+//	# PXE clients asking for windows paths
+//	rg	\\	/
+//	ri	^pxelinux\.cfg/	pxelinux.cfg/
+//	a	\.iso$
+//
+// The flags are:
+//
+//	r  replace the matched text with the replacement
+//	g  replace all matches instead of only the first
+//	i  match case insensitively
+//	e  stop processing the rules if this one matches
+//	s  start over from the first rule if this one matches
+//	a  refuse the request if this rule matches
+//	G  only apply the rule to read requests
+//	P  only apply the rule to write requests
+//	~  apply the rule if the expression does not match
+//
+// A flags field of "-" holds no flags. In the replacement \0 is the
+// whole match, \1 to \9 are subexpressions, \i is the IP address of
+// the client, \x is the same address in uppercase hex as PXE clients
+// use, and \\ is a backslash. Lines starting with # are comments.
+type Remapper struct {
+	rules []remapRule
+}
+
+type remapRule struct {
+	re      *regexp.Regexp
+	repl    string
+	replace bool
+	global  bool
+	end     bool
+	restart bool
+	abort   bool
+	invert  bool
+	get     bool
+	put     bool
+}
+
+// LoadRemap reads remap rules from the named file.
+func LoadRemap(path string) (*Remapper, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseRemap(f)
+}
+
+// ParseRemap reads remap rules from r.
+func ParseRemap(r io.Reader) (*Remapper, error) {
+	m := &Remapper{}
+	scan := bufio.NewScanner(r)
+	for line := 1; scan.Scan(); line++ {
+		fields := strings.Fields(scan.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		rule, err := parseRemapRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("remap rules line %d: %w", line, err)
+		}
+		m.rules = append(m.rules, rule)
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func parseRemapRule(fields []string) (remapRule, error) {
+	var rule remapRule
+	if len(fields) < 2 || len(fields) > 3 {
+		return rule, errors.New("expected flags, expression and replacement")
+	}
+
+	ignoreCase := false
+	for _, f := range fields[0] {
+		switch f {
+		case '-':
+		case 'r':
+			rule.replace = true
+		case 'g':
+			rule.global = true
+		case 'i':
+			ignoreCase = true
+		case 'e':
+			rule.end = true
+		case 's':
+			rule.restart = true
+		case 'a':
+			rule.abort = true
+		case 'G':
+			rule.get = true
+		case 'P':
+			rule.put = true
+		case '~':
+			rule.invert = true
+		default:
+			return rule, fmt.Errorf("unknown flag %q", f)
+		}
+	}
+
+	expr := fields[1]
+	if ignoreCase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return rule, err
+	}
+	rule.re = re
+
+	if rule.replace {
+		if len(fields) != 3 {
+			return rule, errors.New("replace rule without replacement")
+		}
+		rule.repl = fields[2]
+	} else if len(fields) == 3 {
+		return rule, errors.New("replacement given without the r flag")
+	}
+	return rule, nil
+}
+
+// Remap applies the rules to filename, requested by a request of type
+// reqType (pkt.RRQ or pkt.WRQ) from addr. It returns ErrRemapDenied if
+// a rule refuses the request.
+func (m *Remapper) Remap(filename string, reqType uint16, addr net.Addr) (string, error) {
+	passes := 0
+	for i := 0; i < len(m.rules); i++ {
+		rule := &m.rules[i]
+		if (rule.get || rule.put) && !(rule.get && reqType == pkt.RRQ || rule.put && reqType == pkt.WRQ) {
+			continue
+		}
+
+		matches := rule.re.FindAllStringSubmatchIndex(filename, -1)
+		matched := len(matches) > 0
+		if matched == rule.invert {
+			continue
+		}
+
+		if rule.abort {
+			return "", ErrRemapDenied
+		}
+		if rule.replace && !rule.invert {
+			if !rule.global {
+				matches = matches[:1]
+			}
+			filename = rule.expand(filename, matches, addr)
+		}
+		if rule.end {
+			break
+		}
+		if rule.restart {
+			passes++
+			if passes > maxRemapPasses {
+				return "", ErrRemapLoop
+			}
+			i = -1
+		}
+	}
+	return filename, nil
+}
+
+// expand replaces the given matches in name with the rule replacement
+func (r *remapRule) expand(name string, matches [][]int, addr net.Addr) string {
+	var out strings.Builder
+	last := 0
+	for _, match := range matches {
+		out.WriteString(name[last:match[0]])
+		for i := 0; i < len(r.repl); i++ {
+			c := r.repl[i]
+			if c != '\\' || i+1 == len(r.repl) {
+				out.WriteByte(c)
+				continue
+			}
+			i++
+			switch c = r.repl[i]; {
+			case c >= '0' && c <= '9':
+				n := int(c-'0') * 2
+				if n+1 < len(match) && match[n] >= 0 {
+					out.WriteString(name[match[n]:match[n+1]])
+				}
+			case c == 'i':
+				if ip := addrIP(addr); ip != nil {
+					out.WriteString(ip.String())
+				}
+			case c == 'x':
+				if ip := addrIP(addr); ip != nil {
+					fmt.Fprintf(&out, "%X", []byte(ip))
+				}
+			default:
+				out.WriteByte(c)
+			}
+		}
+		last = match[1]
+	}
+	out.WriteString(name[last:])
+	return out.String()
+}
+
+// addrIP returns the IP address of addr, in its 4 byte form for IPv4
+func addrIP(addr net.Addr) net.IP {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+	if ip4 := ua.IP.To4(); ip4 != nil {
+		return ip4
+	}
+	return ua.IP
+}
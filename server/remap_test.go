@@ -0,0 +1,127 @@
+package server_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/whyrusleeping/go-tftp/client"
+	pkt "github.com/whyrusleeping/go-tftp/packet"
+	"github.com/whyrusleeping/go-tftp/server"
+)
+
+const testRemap = `
+# windows clients
+rg	\\	/
+# everything lives under /tftpboot
+r	^/?tftpboot/	/
+ri	^/?PXELINUX\.CFG/	pxelinux.cfg/
+# per client configuration
+rG	^client\.cfg$	hosts/\i/\x.cfg
+e	^pxelinux\.0$
+r	\.0$	.bin
+a	\.iso$
+aP	^pxelinux\.cfg/
+rs	^(.*)\.old$	\1
+`
+
+func TestRemap(t *testing.T) {
+	m, err := server.ParseRemap(strings.NewReader(testRemap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 69}
+
+	tests := []struct {
+		name    string
+		reqType uint16
+		want    string
+		err     error
+	}{
+		{"file", pkt.RRQ, "file", nil},
+		{"boot\\x86\\bcd", pkt.RRQ, "boot/x86/bcd", nil},
+		{"/tftpboot/file", pkt.RRQ, "/file", nil},
+		{"PxeLinux.Cfg/default", pkt.RRQ, "pxelinux.cfg/default", nil},
+		{"client.cfg", pkt.RRQ, "hosts/192.168.0.1/C0A80001.cfg", nil},
+		{"client.cfg", pkt.WRQ, "client.cfg", nil},
+		{"pxelinux.0", pkt.RRQ, "pxelinux.0", nil},
+		{"undionly.0", pkt.RRQ, "undionly.bin", nil},
+		{"image.iso", pkt.RRQ, "", server.ErrRemapDenied},
+		{"pxelinux.cfg/default", pkt.WRQ, "", server.ErrRemapDenied},
+		{"file.old.old", pkt.RRQ, "file", nil},
+		{"file.0.old", pkt.RRQ, "file.bin", nil},
+	}
+	for _, tt := range tests {
+		got, err := m.Remap(tt.name, tt.reqType, addr)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("Remap(%q, %d) = %q, %v, want %q, %v", tt.name, tt.reqType, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestRemapInvertAndLoop(t *testing.T) {
+	m, err := server.ParseRemap(strings.NewReader("~a ^boot/\nrs x y\ns y\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := m.Remap("boot/file", pkt.RRQ, nil)
+	if err != nil || got != "boot/file" {
+		t.Errorf("got %q, %v", got, err)
+	}
+	_, err = m.Remap("other", pkt.RRQ, nil)
+	if !errors.Is(err, server.ErrRemapDenied) {
+		t.Errorf("expected denial outside of boot/, got %v", err)
+	}
+	_, err = m.Remap("boot/y", pkt.RRQ, nil)
+	if !errors.Is(err, server.ErrRemapLoop) {
+		t.Errorf("expected a loop, got %v", err)
+	}
+}
+
+func TestParseRemapErrors(t *testing.T) {
+	bad := []string{
+		"r ^a",
+		"x ^a b",
+		"e ^a b",
+		"r ( b",
+		"r a b c",
+	}
+	for _, rules := range bad {
+		_, err := server.ParseRemap(strings.NewReader("# ok\n" + rules))
+		if err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("ParseRemap(%q) = %v, expected an error on line 2", rules, err)
+		}
+	}
+}
+
+func TestServerRemap(t *testing.T) {
+	fsys := fstest.MapFS{
+		"pxelinux.cfg/default": {Data: []byte("default linux\n")},
+	}
+	s := server.NewFSServer(fsys)
+	s.Remap, _ = server.ParseRemap(strings.NewReader("ri ^pxelinux\\.cfg/ pxelinux.cfg/\na \\.iso$\n"))
+	addr := startServer(t, s)
+
+	cli, err := client.NewTftpClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	out := new(bytes.Buffer)
+	_, err = cli.GetFile("PXELINUX.CFG/default", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "default linux\n" {
+		t.Fatalf("got %q", out)
+	}
+
+	_, err = cli.GetFile("image.iso", out)
+	if !errors.Is(err, pkt.ErrAccessViolation) {
+		t.Fatalf("Expected access violation, got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxFilenameLength is the longest filename a client may request.
+const MaxFilenameLength = 255
+
+// ErrBadFilename is returned for a requested filename that is not
+// allowed, such as one that tries to leave the served directory.
+var ErrBadFilename = errors.New("illegal filename")
+
+// ErrSymlink is returned when a path leads through a symbolic link
+// that the SymlinkPolicy in use does not allow. It matches
+// fs.ErrPermission, so clients are sent an access violation.
+var ErrSymlink = fmt.Errorf("symbolic link not allowed: %w", fs.ErrPermission)
+
+// SymlinkPolicy controls how symbolic links in the served directory
+// are treated.
+type SymlinkPolicy int
+
+const (
+	// SymlinksWithinRoot follows symbolic links as long as they lead
+	// to somewhere inside the served directory. This is the default.
+	SymlinksWithinRoot SymlinkPolicy = iota
+	// SymlinksFollow follows any symbolic link, even out of the
+	// served directory.
+	SymlinksFollow
+	// SymlinksDeny refuses any path that leads through a symbolic link.
+	SymlinksDeny
+)
+
+// ResolveFilename turns a filename requested by a client into a clean,
+// slash separated path relative to the served directory, which is
+// valid according to fs.ValidPath. Leading slashes are stripped, as PXE
+// clients commonly request rooted paths, and backslashes are treated
+// as separators. Names containing a ".." element, NUL or other control
+// characters, or longer than MaxFilenameLength are refused with
+// ErrBadFilename.
+func ResolveFilename(name string) (string, error) {
+	if len(name) > MaxFilenameLength || !utf8.ValidString(name) {
+		return "", ErrBadFilename
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f {
+			return "", ErrBadFilename
+		}
+	}
+
+	name = strings.ReplaceAll(name, "\\", "/")
+	var elems []string
+	for _, elem := range strings.Split(name, "/") {
+		switch elem {
+		case "", ".":
+			// Leading, repeated and trailing slashes
+		case "..":
+			return "", ErrBadFilename
+		default:
+			elems = append(elems, elem)
+		}
+	}
+	if len(elems) == 0 {
+		return "", ErrBadFilename
+	}
+	return strings.Join(elems, "/"), nil
+}
+
+// checkSymlinks checks the symbolic links on the way to name, a path
+// as returned by ResolveFilename, inside of root against policy.
+// Elements of the path that do not exist yet are not checked, so files
+// can still be created. Note that links changed between the check and
+// the file being opened can not be caught.
+func checkSymlinks(root, name string, policy SymlinkPolicy) error {
+	if policy == SymlinksFollow {
+		return nil
+	}
+
+	cur := root
+	for _, elem := range strings.Split(name, "/") {
+		cur = filepath.Join(cur, elem)
+		fi, err := os.Lstat(cur)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&fs.ModeSymlink == 0 {
+			continue
+		}
+		if policy == SymlinksDeny {
+			return ErrSymlink
+		}
+
+		target, err := filepath.EvalSymlinks(cur)
+		if err != nil {
+			// A dangling link could be written through to anywhere
+			return ErrSymlink
+		}
+		realRoot, err := filepath.EvalSymlinks(filepath.Clean(root))
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(realRoot, target)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return ErrSymlink
+		}
+	}
+	return nil
+}
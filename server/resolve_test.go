@@ -0,0 +1,202 @@
+package server_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/whyrusleeping/go-tftp/client"
+	pkt "github.com/whyrusleeping/go-tftp/packet"
+	"github.com/whyrusleeping/go-tftp/server"
+)
+
+func TestResolveFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"pxelinux.0", "pxelinux.0"},
+		{"/pxelinux.0", "pxelinux.0"},
+		{"//boot//grub/grub.cfg", "boot/grub/grub.cfg"},
+		{"\\boot\\bcd", "boot/bcd"},
+		{"./a/./b/", "a/b"},
+		{"a..b", "a..b"},
+		{"..a", "..a"},
+		{"pxelinux.cfg/01-aa-bb-cc-dd-ee-ff", "pxelinux.cfg/01-aa-bb-cc-dd-ee-ff"},
+
+		// Refused
+		{"", ""},
+		{"/", ""},
+		{".", ""},
+		{"..", ""},
+		{"../etc/passwd", ""},
+		{"/../etc/passwd", ""},
+		{"a/../../etc/passwd", ""},
+		{"a/..", ""},
+		{"..\\..\\windows\\win.ini", ""},
+		{"a\\..\\..\\x", ""},
+		{"..//x", ""},
+		{"a\x00/../../x", ""},
+		{"file\x00.txt", ""},
+		{"file\n", ""},
+		{"file\x1b[2J", ""},
+		{"file\x7f", ""},
+		{"\xff\xfe", ""},
+		{strings.Repeat("a", server.MaxFilenameLength+1), ""},
+	}
+	for _, tt := range tests {
+		got, err := server.ResolveFilename(tt.name)
+		if tt.want == "" {
+			if !errors.Is(err, server.ErrBadFilename) {
+				t.Errorf("ResolveFilename(%q) = %q, %v, want ErrBadFilename", tt.name, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ResolveFilename(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+		if !fs.ValidPath(got) {
+			t.Errorf("ResolveFilename(%q) = %q, not a valid path", tt.name, got)
+		}
+	}
+}
+
+// symlinkTree makes a served directory root next to a secret file, with
+// links leading inside and out of root
+func symlinkTree(t *testing.T) string {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	files := map[string]string{
+		"secret":        "secret",
+		"root/file":     "file",
+		"root/sub/file": "sub file",
+	}
+	for name, data := range files {
+		path := filepath.Join(base, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"root/inside":   "file",
+		"root/insub":    "sub",
+		"root/outside":  "../secret",
+		"root/outdir":   "..",
+		"root/absolute": filepath.Join(base, "secret"),
+		"root/dangling": "../missing",
+	}
+	for name, target := range links {
+		err := os.Symlink(target, filepath.Join(base, filepath.FromSlash(name)))
+		if err != nil {
+			t.Skip("symbolic links not supported:", err)
+		}
+	}
+	return root
+}
+
+func TestSymlinkPolicy(t *testing.T) {
+	root := symlinkTree(t)
+	names := []string{"file", "sub/file", "inside", "insub/file", "outside", "outdir/secret", "absolute", "dangling"}
+	allowed := map[server.SymlinkPolicy][]string{
+		server.SymlinksWithinRoot: {"file", "sub/file", "inside", "insub/file"},
+		server.SymlinksFollow:     {"file", "sub/file", "inside", "insub/file", "outside", "outdir/secret", "absolute"},
+		server.SymlinksDeny:       {"file", "sub/file"},
+	}
+	for policy, ok := range allowed {
+		fsys := server.NewDirFS(root, policy)
+		for _, name := range names {
+			f, err := fsys.Open(name)
+			if err == nil {
+				f.Close()
+			}
+			want := false
+			for _, n := range ok {
+				want = want || n == name
+			}
+			if want && err != nil {
+				t.Errorf("policy %d: open %s: %v", policy, name, err)
+			}
+			if !want && err == nil {
+				t.Errorf("policy %d: open %s succeeded", policy, name)
+			}
+		}
+	}
+
+	// Writing through a link out of the root must not create the target
+	fsys := server.DirFS(root)
+	_, err := fsys.Create("dangling")
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("create through dangling link: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "..", "missing")); err == nil {
+		t.Error("file created outside of root")
+	}
+}
+
+func TestTraversal(t *testing.T) {
+	root := symlinkTree(t)
+	attacks := []string{
+		"../secret",
+		"/../secret",
+		"sub/../../secret",
+		"..\\secret",
+		"sub\\..\\..\\secret",
+		"outside",
+		"outdir/secret",
+		"absolute",
+	}
+
+	servers := map[string]*server.Server{
+		"DirFS": server.NewFSServer(server.DirFS(root)),
+		"FuncHandler": server.NewServer(root, func(path string) (r io.Reader, err error) {
+			return os.Open(path)
+		}, func(path string) (w io.Writer, err error) {
+			return os.Create(path)
+		}),
+	}
+	for name, s := range servers {
+		addr := startServer(t, s)
+		cli, err := client.NewTftpClient(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+
+		out := new(bytes.Buffer)
+		_, err = cli.GetFile("/sub/file", out)
+		if err != nil || out.String() != "sub file" {
+			t.Fatalf("%s: get sub/file: %q, %v", name, out, err)
+		}
+
+		for _, attack := range attacks {
+			out.Reset()
+			_, err := cli.GetFile(attack, out)
+			if !errors.Is(err, pkt.ErrAccessViolation) {
+				t.Errorf("%s: get %q: expected access violation, got %v", name, attack, err)
+			}
+			if out.Len() > 0 {
+				t.Errorf("%s: get %q leaked %q", name, attack, out)
+			}
+
+			_, err = cli.PutFile(attack, strings.NewReader("overwritten"))
+			if !errors.Is(err, pkt.ErrAccessViolation) {
+				t.Errorf("%s: put %q: expected access violation, got %v", name, attack, err)
+			}
+		}
+
+		secret, err := os.ReadFile(filepath.Join(root, "..", "secret"))
+		if err != nil || string(secret) != "secret" {
+			t.Fatalf("%s: secret was overwritten: %q, %v", name, secret, err)
+		}
+	}
+}
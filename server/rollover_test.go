@@ -0,0 +1,140 @@
+package server_test
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/whyrusleeping/go-tftp/client"
+	"github.com/whyrusleeping/go-tftp/server"
+)
+
+// pattern is the synthetic content at each offset of the test files,
+// chosen so that misplaced blocks are detected
+func pattern(off int64) byte {
+	return byte((off * 0x9E3779B1) >> 13)
+}
+
+// patternReader generates size bytes of pattern without storing them
+type patternReader struct {
+	off, size int64
+}
+
+func (r *patternReader) Read(b []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > r.size-r.off {
+		b = b[:r.size-r.off]
+	}
+	for i := range b {
+		b[i] = pattern(r.off + int64(i))
+	}
+	r.off += int64(len(b))
+	return len(b), nil
+}
+
+// patternWriter checks that what is written to it matches pattern
+type patternWriter struct {
+	mu  sync.Mutex
+	off int64
+	err error
+}
+
+func (w *patternWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i, c := range b {
+		if c != pattern(w.off+int64(i)) && w.err == nil {
+			w.err = fmt.Errorf("mismatch at offset %d", w.off+int64(i))
+		}
+	}
+	w.off += int64(len(b))
+	return len(b), nil
+}
+
+// result returns the number of bytes written and the first mismatch
+func (w *patternWriter) result() (int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.off, w.err
+}
+
+// startPatternServer starts a server whose files are size bytes of
+// pattern, with uploads checked against pattern by w. It returns the
+// address the server listens on.
+func startPatternServer(t *testing.T, size int64, w *patternWriter) string {
+	s := server.NewServer("",
+		func(string) (io.Reader, error) {
+			return &patternReader{size: size}, nil
+		},
+		func(string) (io.Writer, error) {
+			return w, nil
+		})
+	s.MaxBlockSize = 65464
+	return startServer(t, s)
+}
+
+// testTransfers downloads and uploads size bytes of pattern, checking
+// the content arrives intact
+func testTransfers(t *testing.T, size int64, blksize, windowsize int, rollover uint16) {
+	w := new(patternWriter)
+	addr := startPatternServer(t, size, w)
+
+	cli, err := client.NewTftpClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.Blocksize = blksize
+	cli.WindowSize = windowsize
+	cli.Rollover = rollover
+	cli.Timeout = time.Millisecond * 100
+
+	out := new(patternWriter)
+	n, err := cli.GetFile("pattern", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(n) != size || out.off != size {
+		t.Fatalf("downloaded %d bytes, expected %d", n, size)
+	}
+	if out.err != nil {
+		t.Fatal(out.err)
+	}
+
+	n, err = cli.PutFile("pattern", &patternReader{size: size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, werr := w.result()
+	if int64(n) != size || got != size {
+		t.Fatalf("uploaded %d bytes, server got %d, expected %d", n, got, size)
+	}
+	if werr != nil {
+		t.Fatal(werr)
+	}
+}
+
+func TestBlockNumberRollover(t *testing.T) {
+	// Small blocks take the block number past 65535 twice
+	const blksize = 8
+	const size = blksize*(2*65536+100) + 3
+
+	for _, rollover := range []uint16{0, 1} {
+		t.Run(fmt.Sprintf("rollover=%d", rollover), func(t *testing.T) {
+			testTransfers(t, size, blksize, 16, rollover)
+		})
+	}
+}
+
+func TestMultiGigabyteTransfer(t *testing.T) {
+	if os.Getenv("TFTP_LONG_TESTS") == "" {
+		t.Skip("set TFTP_LONG_TESTS to run the multi-gigabyte transfer")
+	}
+	// Enough maximum sized blocks to roll the block number over
+	testTransfers(t, 5<<30, 65464, 2, 0)
+}
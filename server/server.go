@@ -2,10 +2,14 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"io"
 	"log"
 	"net"
+	"runtime/debug"
+	"strings"
+	"sync"
 	"time"
 
 	pkt "github.com/whyrusleeping/go-tftp/packet"
@@ -16,26 +20,44 @@ import (
 // TFTP (4 bytes), UDP (8 bytes) and IP (20 bytes). (source: google).
 const TftpMaxPacketSize = 1468
 
-// AckTimeout is the total time to wait before timing out on an ACK.
-var AckTimeout = time.Second * 20
-
-// RetransmitTime is how long to wait before retransmitting a packet
-// if an ACK has not yet been received.
-var RetransmitTime = time.Second * 5
-
 // ErrTimeout is returned when an action times out.
 var ErrTimeout = errors.New("timed out")
 
+// ErrTooLarge is returned when an upload exceeds the
+// servers MaxWriteSize.
+var ErrTooLarge = errors.New("upload too large")
+
+// ErrBadMode is returned when a client requests a transfer
+// mode other than netascii or octet.
+var ErrBadMode = errors.New("unsupported transfer mode")
+
 // ErrUnexpectedPacket is returned when one packet type is
 // received when a different one was expected.
 var ErrUnexpectedPacket = errors.New("unexpected packet received")
 
-// Function types for read and write abstraction
+// ErrServerClosed is returned by Serve and ListenAndServe after a call
+// to Shutdown or Close.
+var ErrServerClosed = errors.New("server closed")
+
+// errServerClosing is sent to the clients of transfers aborted by Close,
+// and of requests refused while shutting down
+var errServerClosing = errors.New("server shutting down")
+
+// Function types for read and write abstraction. A partial upload is
+// only discarded if the writer is an Aborter, or an *os.File opened at
+// filename, see FuncHandler.
 type ReaderFunc func(filename string) (r io.Reader, err error)
 type WriterFunc func(filename string) (r io.Writer, err error)
 
 // Server is a TFTP server.
 type Server struct {
+	// Config holds the retransmit settings of the transfers
+	Config
+
+	// Handler answers requests. If it is nil, a FuncHandler using
+	// ReadFunc and WriteFunc is used.
+	Handler Handler
+
 	// the directory to read and write files from.
 	servdir string
 	// functions for reading and writing
@@ -43,6 +65,68 @@ type Server struct {
 	WriteFunc WriterFunc
 	// Set true to disable writes
 	ReadOnly bool
+
+	// Range of block sizes accepted from the blksize option. Requests
+	// above the maximum are clamped to it, requests below the minimum
+	// are ignored. Zero values select 8 and TftpMaxPacketSize, and
+	// MaxBlockSize is never above 65464, the limit of rfc 2348.
+	MinBlockSize int
+	MaxBlockSize int
+
+	// MaxWindowSize is the largest windowsize accepted for reads,
+	// larger requests are clamped to it. Zero selects 64.
+	MaxWindowSize int
+
+	// MaxWriteSize limits the size of uploaded files, zero means
+	// no limit. Uploads over it are refused with a disk full error.
+	MaxWriteSize int64
+
+	// Symlinks sets how the default FuncHandler treats symbolic
+	// links under the served directory.
+	Symlinks SymlinkPolicy
+
+	// Remap, if set, rewrites requested filenames before they are
+	// resolved, see Remapper.
+	Remap *Remapper
+
+	// ListenTransfer opens the socket for each transfer, by default a
+	// UDP socket on a free port. Tests can replace it to simulate an
+	// unreliable network.
+	ListenTransfer func() (net.PacketConn, error)
+
+	// SinglePort keeps all transfers on the port Serve receives
+	// requests on, for clients behind firewalls and NAT that only
+	// pass that port. Packets are routed to transfers by the address
+	// of the client. By default each transfer has a port of its own.
+	SinglePort bool
+	sessions   sessionTable
+
+	// flights holds the requests being served, other than in single
+	// port mode where sessions serve the same purpose
+	flights flightTable
+
+	// MaxSessions limits the number of transfers running at once,
+	// zero means no limit. Requests over it wait for a transfer to
+	// end, in a queue of up to MaxPending requests. Requests that do
+	// not fit in the queue are refused with ErrBusy. MaxPending has
+	// no effect without MaxSessions.
+	MaxSessions int
+	MaxPending  int
+
+	// MaxSessionsPerIP limits the number of requests, running or
+	// pending, from each client IP address. Zero means no limit.
+	MaxSessionsPerIP int
+
+	mu sync.Mutex
+	// closing is set by Shutdown and Close, closed only by Close
+	closing   bool
+	closed    bool
+	listeners map[net.PacketConn]struct{}
+	// active counts the requests being handled, conns holds the
+	// sockets of their transfers
+	active int
+	conns  map[*transferConn]context.CancelFunc
+	limits limits
 }
 
 // NewServer returns a new tftp Server instance that will
@@ -55,8 +139,65 @@ func NewServer(dir string, rf ReaderFunc, wr WriterFunc) *Server {
 	}
 }
 
+func (s *Server) handler() Handler {
+	if s.Handler != nil {
+		return s.Handler
+	}
+	return &funcHandler{
+		dir:       s.servdir,
+		readFunc:  s.ReadFunc,
+		writeFunc: s.WriteFunc,
+		symlinks:  s.Symlinks,
+	}
+}
+
+// newRequest builds the Request passed to the handler, refusing the
+// request with an access violation if its filename is not allowed
+func (s *Server) newRequest(ctx context.Context, req *pkt.ReqPacket, addr *net.UDPAddr, con *transferConn) (*Request, error) {
+	name, err := ResolveFilename(req.Filename)
+	if err != nil {
+		errPkt := pkt.ErrorPacket{}
+		errPkt.Value = err.Error()
+		errPkt.Code = pkt.TFTPErrAccessViolation
+		con.Write(errPkt.Bytes())
+		return nil, err
+	}
+
+	return &Request{
+		Type:     req.Type,
+		Addr:     addr,
+		Filename: name,
+		Mode:     strings.ToLower(req.Mode),
+		Options:  req.Options,
+		ctx:      ctx,
+	}, nil
+}
+
+// sendError sends the client the TFTP error for err
+func sendError(con *transferConn, err error) error {
+	_, werr := con.Write(pkt.NewErrorPacket(err).Bytes())
+	return werr
+}
+
+// refuse sends addr the TFTP error for err from a new port, as for
+// requests refused before their transfer is started
+func (s *Server) refuse(addr *net.UDPAddr, err error) error {
+	con, derr := s.dial(addr)
+	if derr != nil {
+		return derr
+	}
+	defer con.Close()
+	return sendError(con, err)
+}
+
 // Handle a new client read or write request.
 func (s *Server) HandleClient(addr *net.UDPAddr, req pkt.Packet) {
+	s.handleClient(addr, req, nil)
+}
+
+// handleClient handles a request, telling f of the first reply so that
+// retransmits of the request can be answered
+func (s *Server) handleClient(addr *net.UDPAddr, req pkt.Packet, f *flight) {
 	log.Println("Handle Client!")
 
 	reqpkt, ok := req.(*pkt.ReqPacket)
@@ -71,15 +212,28 @@ func (s *Server) HandleClient(addr *net.UDPAddr, req pkt.Packet) {
 		return
 	}
 
+	if s.Remap != nil {
+		name, err := s.Remap.Remap(reqpkt.Filename, reqpkt.Type, clientaddr)
+		if err != nil {
+			log.Printf("refused request for %s: %s", reqpkt.Filename, err)
+			s.refuse(clientaddr, &pkt.ErrorPacket{Code: pkt.TFTPErrAccessViolation, Value: err.Error()})
+			return
+		}
+		if name != reqpkt.Filename {
+			log.Printf("remapped %s to %s", reqpkt.Filename, name)
+			reqpkt.Filename = name
+		}
+	}
+
 	switch reqpkt.GetType() {
 	case pkt.RRQ:
-		err := s.HandleReadReq(reqpkt, clientaddr)
+		err := s.handleReadReq(reqpkt, clientaddr, f)
 		if err != nil {
 			log.Println("read request finished, with error:")
 			log.Println(err)
 		}
 	case pkt.WRQ:
-		err := s.HandleWriteReq(reqpkt, clientaddr)
+		err := s.handleWriteReq(reqpkt, clientaddr, f)
 		if err != nil {
 			log.Println("write request finished, with error:")
 			log.Println(err)
@@ -89,35 +243,279 @@ func (s *Server) HandleClient(addr *net.UDPAddr, req pkt.Packet) {
 	}
 }
 
-// Serve opens up a udp socket listening on the given
-// address and handles incoming connections received on it
-func (s *Server) Serve(addr string) error {
-	uaddr, err := net.ResolveUDPAddr("udp", addr)
+// ListenAndServe listens on the UDP address addr and then calls Serve
+// to handle requests received on it.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.ListenPacket("udp", addr)
 	if err != nil {
 		return err
 	}
+	return s.Serve(l)
+}
 
-	uconn, err := net.ListenUDP("udp", uaddr)
-	if err != nil {
-		return err
+// Serve handles requests received on l, starting a transfer for each
+// from a port of its own. It always returns a non-nil error, and closes
+// l. After Shutdown or Close it returns ErrServerClosed.
+func (s *Server) Serve(l net.PacketConn) error {
+	defer l.Close()
+	if !s.trackListener(l, true) {
+		return ErrServerClosed
 	}
+	defer s.trackListener(l, false)
 
+	size := TftpMaxPacketSize
+	if s.SinglePort {
+		// Uploads arrive here too
+		size = s.maxBlockSize() + 4
+	}
+	buf := make([]byte, size)
 	for { // read in new requests
-		buf := make([]byte, TftpMaxPacketSize) // TODO: sync.Pool
-		n, ua, err := uconn.ReadFromUDP(buf)
+		n, addr, err := l.ReadFrom(buf)
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
 			return err
 		}
 
+		p := append([]byte(nil), buf[:n]...)
+		if s.SinglePort && s.sessions.deliver(addr, p) {
+			continue
+		}
+
 		log.Println("New Connection!")
 
-		buf = buf[:n]
-		packet, err := pkt.ParsePacket(buf)
+		packet, err := pkt.ParsePacket(p)
 		if err != nil {
 			log.Printf("Got bad packet: %s", err)
+			var perr *pkt.ParseError
+			if errors.As(err, &perr) && (perr.Opcode == pkt.RRQ || perr.Opcode == pkt.WRQ) {
+				// Let the client know why its request was refused
+				errPkt := pkt.ErrorPacket{}
+				errPkt.Value = perr.Err.Error()
+				errPkt.Code = pkt.TFTPErrIllegalOp
+				l.WriteTo(errPkt.Bytes(), addr)
+			}
 			continue
 		}
 
-		go s.HandleClient(ua, packet)
+		req, ok := packet.(*pkt.ReqPacket)
+		if !ok {
+			// Not part of any transfer we know of
+			log.Printf("ignoring packet of type %d from %s", packet.GetType(), addr)
+			if s.SinglePort && (packet.GetType() == pkt.DATA || packet.GetType() == pkt.ACK) {
+				// There is no session of addr it could be meant
+				// for (rfc 1350). Errors are never answered.
+				l.WriteTo(errUnknownTID.Bytes(), addr)
+			}
+			continue
+		}
+
+		// A client resends its request until it hears from us, those
+		// must not start more transfers of the same file
+		var f *flight
+		if !s.SinglePort {
+			f = s.flights.start(addr, req)
+			if f == nil {
+				log.Printf("dropping retransmitted request from %s", addr)
+				continue
+			}
+		}
+		if !s.startRequest() {
+			// Shutting down, but there may still be transfers
+			// to serve in single port mode
+			l.WriteTo(pkt.NewErrorPacket(errServerClosing).Bytes(), addr)
+			s.endFlight(f)
+			continue
+		}
+		ip := clientIP(addr)
+		if !s.admit(ip) {
+			// Refused from here rather than a port of its own, so
+			// that a flood of requests costs no sockets
+			log.Printf("refusing request from %s: %s", addr, ErrBusy)
+			l.WriteTo(pkt.NewErrorPacket(ErrBusy).Bytes(), addr)
+			s.endFlight(f)
+			s.endRequest()
+			continue
+		}
+		var sc *sessionConn
+		if s.SinglePort {
+			sc = s.sessions.open(l, addr, p)
+		}
+		go s.serveRequest(addr, ip, packet, sc, f)
+	}
+}
+
+// serveRequest handles a request received by Serve, recovering from
+// any panic so that it only takes down its own transfer. sc is the
+// session of the request in single port mode, f its flight otherwise.
+// The request waits in the pending queue until MaxSessions allows it to
+// start.
+func (s *Server) serveRequest(addr net.Addr, ip string, packet pkt.Packet, sc *sessionConn, f *flight) {
+	defer s.endRequest()
+	if sc != nil {
+		defer sc.Close()
+	}
+	defer s.endFlight(f)
+	defer s.release(ip)
+	if !s.acquire() {
+		log.Printf("dropping pending request from %s: %s", addr, ErrServerClosed)
+		if ua, ok := addr.(*net.UDPAddr); ok {
+			s.refuse(ua, errServerClosing)
+		}
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic serving %s: %v\n%s", addr, r, debug.Stack())
+		}
+	}()
+
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		var err error
+		ua, err = net.ResolveUDPAddr("udp", addr.String())
+		if err != nil {
+			log.Printf("Error: %s", err)
+			return
+		}
 	}
+	s.handleClient(ua, packet, f)
+}
+
+func (s *Server) endFlight(f *flight) {
+	if f != nil {
+		s.flights.end(f)
+	}
+}
+
+// shutdownPollInterval is how often Shutdown checks for the last
+// transfer to finish
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown stops the server from accepting new requests, closing all
+// of its listeners, and then waits for running transfers to finish. If
+// ctx expires first its error is returned, and the remaining transfers
+// can be aborted with Close. In single port mode the listeners are
+// only closed once the transfers are done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	var err error
+	if !s.SinglePort {
+		err = s.closeListenersLocked()
+	}
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		active := s.active
+		if active == 0 && s.SinglePort {
+			err = s.closeListenersLocked()
+		}
+		s.mu.Unlock()
+		if active == 0 {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close immediately closes all listeners and aborts running transfers,
+// sending each client an error.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closing = true
+	s.closed = true
+	s.wakePendingLocked()
+	for con, cancel := range s.conns {
+		sendError(con, errServerClosing)
+		cancel()
+		con.Close()
+	}
+	// In single port mode the errors above are sent through the
+	// listeners, so they are closed last
+	return s.closeListenersLocked()
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// trackListener adds or removes a listener of Serve, reporting false
+// if it cannot be added as the server is shutting down
+func (s *Server) trackListener(l net.PacketConn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+	if s.closing {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.PacketConn]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) closeListenersLocked() error {
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// startRequest counts a request being handled, unless the server is
+// shutting down
+func (s *Server) startRequest() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.active++
+	return true
+}
+
+func (s *Server) endRequest() {
+	s.mu.Lock()
+	s.active--
+	s.mu.Unlock()
+}
+
+// trackConn registers the socket of a transfer, so that Close can
+// abort it by calling cancel and closing con
+func (s *Server) trackConn(con *transferConn, cancel context.CancelFunc) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrServerClosed
+	}
+	if s.conns == nil {
+		s.conns = make(map[*transferConn]context.CancelFunc)
+	}
+	s.conns[con] = cancel
+	return nil
+}
+
+func (s *Server) untrackConn(con *transferConn) {
+	s.mu.Lock()
+	delete(s.conns, con)
+	s.mu.Unlock()
 }
@@ -0,0 +1,20 @@
+package server_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/whyrusleeping/go-tftp/server"
+)
+
+// startServer runs s on a free loopback port, returning its address.
+// The server is closed at the end of the test.
+func startServer(t *testing.T, s *server.Server) string {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return l.LocalAddr().String()
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// sessionQueue is the number of packets queued for a session in
+// single port mode before more are dropped
+const sessionQueue = 64
+
+// sessionTable routes the packets received by Serve in single port
+// mode to the sessions of their senders.
+type sessionTable struct {
+	mu       sync.Mutex
+	sessions map[string]*sessionConn
+}
+
+// deliver passes p from addr on to its session, reporting whether
+// there is one. Retransmits of the request of a session are passed on
+// too, as they mean the client missed our reply. Any other request
+// ends the session so that a new one can start.
+func (t *sessionTable) deliver(addr net.Addr, p []byte) bool {
+	t.mu.Lock()
+	sc, ok := t.sessions[addr.String()]
+	t.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	if isRequest(p) && !bytes.Equal(p, sc.req) {
+		sc.Close()
+		return false
+	}
+
+	select {
+	case sc.in <- p:
+	default:
+		// Dropped, as by a full socket buffer
+	}
+	return true
+}
+
+// open starts a session for the request req from addr, answered
+// through l
+func (t *sessionTable) open(l net.PacketConn, addr net.Addr, req []byte) *sessionConn {
+	sc := &sessionConn{
+		l:       l,
+		peer:    addr,
+		req:     req,
+		table:   t,
+		in:      make(chan []byte, sessionQueue),
+		closed:  make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+	t.mu.Lock()
+	if t.sessions == nil {
+		t.sessions = make(map[string]*sessionConn)
+	}
+	t.sessions[addr.String()] = sc
+	t.mu.Unlock()
+	return sc
+}
+
+// get returns the session of addr, or nil
+func (t *sessionTable) get(addr net.Addr) *sessionConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sessions[addr.String()]
+}
+
+func (t *sessionTable) remove(sc *sessionConn) {
+	t.mu.Lock()
+	if t.sessions[sc.peer.String()] == sc {
+		delete(t.sessions, sc.peer.String())
+	}
+	t.mu.Unlock()
+}
+
+// isRequest reports whether p is a read or write request
+func isRequest(p []byte) bool {
+	return len(p) >= 2 && p[0] == 0 && (p[1] == 1 || p[1] == 2)
+}
+
+// sessionConn is the transfer socket of a session in single port mode.
+// It sends through the listening socket, and reads the packets that
+// Serve routes to it.
+type sessionConn struct {
+	l     net.PacketConn
+	peer  net.Addr
+	req   []byte
+	table *sessionTable
+	in    chan []byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	mu       sync.Mutex
+	deadline time.Time
+	// changed is closed and replaced when the deadline changes
+	changed chan struct{}
+}
+
+func (c *sessionConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline, changed := c.deadline, c.changed
+		c.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		var p []byte
+		var err error
+		select {
+		case p = <-c.in:
+		case <-c.closed:
+			err = net.ErrClosed
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-changed:
+			// Start over with the new deadline
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if err != nil {
+			return 0, nil, err
+		}
+		if p != nil {
+			return copy(b, p), c.peer, nil
+		}
+	}
+}
+
+func (c *sessionConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return c.l.WriteTo(b, addr)
+}
+
+// Close ends the session, the listening socket stays open
+func (c *sessionConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.table.remove(c)
+	})
+	return nil
+}
+
+func (c *sessionConn) LocalAddr() net.Addr {
+	return c.l.LocalAddr()
+}
+
+func (c *sessionConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *sessionConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline does nothing, writes go straight to the listening
+// socket
+func (c *sessionConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,163 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/whyrusleeping/go-tftp/client"
+	pkt "github.com/whyrusleeping/go-tftp/packet"
+	"github.com/whyrusleeping/go-tftp/server"
+)
+
+func TestSinglePort(t *testing.T) {
+	data := bytes.Repeat([]byte("single port "), 5000)
+	w := new(patternWriter)
+	s := server.NewServer("",
+		func(string) (io.Reader, error) {
+			return bytes.NewReader(data), nil
+		},
+		func(string) (io.Writer, error) {
+			return w, nil
+		})
+	s.SinglePort = true
+	s.MaxBlockSize = 8192
+	addr := startServer(t, s)
+
+	// Every reply comes from the port the request was sent to
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	saddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rrq := &pkt.ReqPacket{Type: pkt.RRQ, Filename: "file", Mode: pkt.ModeOctet}
+	conn.WriteTo(rrq.Bytes(), saddr)
+	buf := make([]byte, 1024)
+	for blk := uint16(1); ; blk++ {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from.String() != addr {
+			t.Fatalf("reply from %s, expected %s", from, addr)
+		}
+		p, err := pkt.ParsePacket(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, ok := p.(*pkt.DataPacket)
+		if !ok || d.BlockNum != blk {
+			t.Fatalf("expected DATA(%d), got %v", blk, p)
+		}
+		conn.WriteTo(pkt.NewAck(blk).Bytes(), saddr)
+		if len(d.Data) < 512 {
+			break
+		}
+	}
+
+	// Concurrent transfers are kept apart by the client address
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cli, err := client.NewTftpClient(addr)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer cli.Close()
+			cli.Blocksize = 512 << (i % 4)
+			cli.WindowSize = i % 3
+
+			out := new(bytes.Buffer)
+			_, err = cli.GetFile("file", out)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(out.Bytes(), data) {
+				errs <- fmt.Errorf("client %d: data mismatch", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// Uploads with blocks larger than TftpMaxPacketSize
+	cli, err := client.NewTftpClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.Blocksize = 8192
+	cli.WindowSize = 4
+	_, err = cli.PutFile("upload", &patternReader{size: 100000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := w.result(); n != 100000 || err != nil {
+		t.Fatalf("server got %d bytes, %v", n, err)
+	}
+}
+
+func TestSinglePortShutdown(t *testing.T) {
+	s, started, release := blockingServer()
+	s.SinglePort = true
+	addr := startServer(t, s)
+
+	cli, err := client.NewTftpClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	out := new(bytes.Buffer)
+	got := make(chan error, 1)
+	go func() {
+		_, err := cli.GetFile("file", out)
+		got <- err
+	}()
+	<-started
+
+	// The listener stays open for the running transfer
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	time.Sleep(100 * time.Millisecond)
+
+	// but new requests are refused
+	late, err := client.NewTftpClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer late.Close()
+	_, err = late.GetFile("file", new(bytes.Buffer))
+	if err == nil || err.Error() != "server shutting down" {
+		t.Fatalf("expected refusal while shutting down, got %v", err)
+	}
+
+	close(release)
+	if err := <-got; err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "finished" {
+		t.Fatalf("got %q", out)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,166 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/whyrusleeping/go-tftp/client"
+	"github.com/whyrusleeping/go-tftp/server"
+)
+
+// blockingServer returns a server whose handler reports each request
+// on started and then waits for release, or for the request context
+// to be canceled, before answering
+func blockingServer() (s *server.Server, started chan *server.Request, release chan struct{}) {
+	started = make(chan *server.Request, 1)
+	release = make(chan struct{})
+	s = &server.Server{
+		Handler: server.HandlerFunc(func(w server.ResponseWriter, r *server.Request) {
+			started <- r
+			select {
+			case <-release:
+				w.Write([]byte("finished"))
+			case <-r.Context().Done():
+			}
+		}),
+	}
+	return s, started, release
+}
+
+func TestShutdown(t *testing.T) {
+	s, started, release := blockingServer()
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(l) }()
+
+	cli, err := client.NewTftpClient(l.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	out := new(bytes.Buffer)
+	got := make(chan error, 1)
+	go func() {
+		_, err := cli.GetFile("file", out)
+		got <- err
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+
+	if err := <-served; !errors.Is(err, server.ErrServerClosed) {
+		t.Fatalf("Serve returned %v", err)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v with a transfer running", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The running transfer is allowed to finish
+	close(release)
+	if err := <-got; err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "finished" {
+		t.Fatalf("got %q", out)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Serve(l); !errors.Is(err, server.ErrServerClosed) {
+		t.Fatalf("Serve after Shutdown returned %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	s, started, _ := blockingServer()
+	addr := startServer(t, s)
+
+	cli, err := client.NewTftpClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	go cli.GetFile("file", nil)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown returned %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	s, started, _ := blockingServer()
+	addr := startServer(t, s)
+
+	cli, err := client.NewTftpClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	got := make(chan error, 1)
+	go func() {
+		_, err := cli.GetFile("file", nil)
+		got <- err
+	}()
+	r := <-started
+
+	s.Close()
+	select {
+	case <-r.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("request context not canceled by Close")
+	}
+	err = <-got
+	if err == nil || !strings.Contains(err.Error(), "shutting down") {
+		t.Fatalf("Expected the client to be told of the shutdown, got %v", err)
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	s := &server.Server{
+		Handler: server.HandlerFunc(func(w server.ResponseWriter, r *server.Request) {
+			if r.Filename == "panic" {
+				panic("handler bug")
+			}
+			w.Write([]byte("ok"))
+		}),
+	}
+	addr := startServer(t, s)
+
+	cli, err := client.NewTftpClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	_, err = cli.GetFile("panic", nil)
+	if err == nil || !strings.Contains(err.Error(), "internal server error") {
+		t.Fatalf("Expected an internal server error, got %v", err)
+	}
+
+	// The server keeps going
+	out := new(bytes.Buffer)
+	_, err = cli.GetFile("file", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "ok" {
+		t.Fatalf("got %q", out)
+	}
+}
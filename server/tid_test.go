@@ -0,0 +1,162 @@
+package server_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	pkt "github.com/whyrusleeping/go-tftp/packet"
+	"github.com/whyrusleeping/go-tftp/server"
+)
+
+// udpPeer is a bare UDP socket speaking TFTP packets
+type udpPeer struct {
+	t    *testing.T
+	conn net.PacketConn
+	buf  []byte
+}
+
+func newPeer(t *testing.T) *udpPeer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &udpPeer{t: t, conn: conn, buf: make([]byte, 65536)}
+}
+
+func (p *udpPeer) send(packet pkt.Packet, addr net.Addr) {
+	p.t.Helper()
+	if _, err := p.conn.WriteTo(packet.Bytes(), addr); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+func (p *udpPeer) recv() (pkt.Packet, net.Addr) {
+	p.t.Helper()
+	return p.recvWithin(time.Second)
+}
+
+// recvWithin is recv waiting up to d for the packet
+func (p *udpPeer) recvWithin(d time.Duration) (pkt.Packet, net.Addr) {
+	p.t.Helper()
+	p.conn.SetReadDeadline(time.Now().Add(d))
+	n, from, err := p.conn.ReadFrom(p.buf)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	packet, err := pkt.ParsePacket(p.buf[:n])
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return packet, from
+}
+
+// expectUnknownTID checks that the next packet p receives is an
+// unknown transfer ID error from addr
+func (p *udpPeer) expectUnknownTID(addr net.Addr) {
+	p.t.Helper()
+	packet, from := p.recv()
+	if from.String() != addr.String() || !errors.Is(packet.(error), pkt.ErrUnknownTID) {
+		p.t.Fatalf("expected unknown transfer ID error from %s, got %v from %s", addr, packet, from)
+	}
+}
+
+func TestUnknownTID(t *testing.T) {
+	uploads := make(chan []byte, 1)
+	s := &server.Server{
+		Handler: server.HandlerFunc(func(w server.ResponseWriter, r *server.Request) {
+			if r.Type == pkt.WRQ {
+				b, _ := io.ReadAll(r.Body)
+				uploads <- b
+				return
+			}
+			w.Write(bytes.Repeat([]byte("a"), 600))
+		}),
+	}
+	saddr, err := net.ResolveUDPAddr("udp", startServer(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newPeer(t)
+	stranger := newPeer(t)
+
+	// A stranger cannot acknowledge blocks of a download
+	client.send(&pkt.ReqPacket{Type: pkt.RRQ, Filename: "file", Mode: pkt.ModeOctet}, saddr)
+	p, port := client.recv()
+	if d, ok := p.(*pkt.DataPacket); !ok || d.BlockNum != 1 {
+		t.Fatalf("expected DATA(1), got %v", p)
+	}
+	stranger.send(pkt.NewAck(1), port)
+	stranger.expectUnknownTID(port)
+	client.send(pkt.NewAck(1), port)
+	p, _ = client.recv()
+	if d, ok := p.(*pkt.DataPacket); !ok || d.BlockNum != 2 || len(d.Data) != 88 {
+		t.Fatalf("expected DATA(2), got %v", p)
+	}
+	client.send(pkt.NewAck(2), port)
+
+	// Nor inject data into an upload, or end it with an error
+	client.send(&pkt.ReqPacket{Type: pkt.WRQ, Filename: "upload", Mode: pkt.ModeOctet}, saddr)
+	p, port = client.recv()
+	if !bytes.Equal(p.Bytes(), pkt.NewAck(0).Bytes()) {
+		t.Fatalf("expected ACK(0), got %v", p)
+	}
+	stranger.send(&pkt.DataPacket{BlockNum: 1, Data: []byte("hijacked")}, port)
+	stranger.expectUnknownTID(port)
+	stranger.send(&pkt.ErrorPacket{Code: pkt.TFTPErrUndefined, Value: "abort"}, port)
+
+	client.send(&pkt.DataPacket{BlockNum: 1, Data: []byte("uploaded")}, port)
+	if p, _ := client.recv(); !bytes.Equal(p.Bytes(), pkt.NewAck(1).Bytes()) {
+		t.Fatalf("expected ACK(1), got %v", p)
+	}
+	if b := <-uploads; string(b) != "uploaded" {
+		t.Fatalf("server got %q", b)
+	}
+
+	// Errors are not answered
+	stranger.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := stranger.conn.ReadFrom(stranger.buf); err == nil {
+		t.Fatal("stranger got a reply to an error")
+	}
+}
+
+func TestUnknownTIDSinglePort(t *testing.T) {
+	s := &server.Server{
+		Handler: server.HandlerFunc(func(w server.ResponseWriter, r *server.Request) {
+			w.Write(bytes.Repeat([]byte("a"), 600))
+		}),
+		SinglePort: true,
+	}
+	peer, saddr := startPeer(t, s)
+	stranger := newPeer(t)
+
+	// Packets from an address without a session are refused from the
+	// shared port, also while another client's transfer runs on it
+	peer.send(&pkt.ReqPacket{Type: pkt.RRQ, Filename: "file", Mode: pkt.ModeOctet}, saddr)
+	p, _ := peer.recv()
+	if d, ok := p.(*pkt.DataPacket); !ok || d.BlockNum != 1 {
+		t.Fatalf("expected DATA(1), got %v", p)
+	}
+	stranger.send(pkt.NewAck(1), saddr)
+	stranger.expectUnknownTID(saddr)
+	stranger.send(&pkt.DataPacket{BlockNum: 1, Data: []byte("stray")}, saddr)
+	stranger.expectUnknownTID(saddr)
+
+	peer.send(pkt.NewAck(1), saddr)
+	p, _ = peer.recv()
+	if d, ok := p.(*pkt.DataPacket); !ok || d.BlockNum != 2 || len(d.Data) != 88 {
+		t.Fatalf("expected DATA(2), got %v", p)
+	}
+	peer.send(pkt.NewAck(2), saddr)
+
+	// Errors are not answered
+	stranger.send(&pkt.ErrorPacket{Code: pkt.TFTPErrUndefined, Value: "abort"}, saddr)
+	stranger.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := stranger.conn.ReadFrom(stranger.buf); err == nil {
+		t.Fatal("stranger got a reply to an error")
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/whyrusleeping/go-tftp/internal/rtt"
+	pkt "github.com/whyrusleeping/go-tftp/packet"
+)
+
+// transfer is the retransmit state of a transfer with one client. The
+// packets last sent are retransmitted each time the client is quiet for
+// the retransmit timeout, until the transfer is given up after
+// opts.retries retransmits. The timeout follows the round trip time
+// measured from our packets to the answers of the client, and doubles
+// with every retransmit.
+//
+// It runs on the goroutine of the transfer, waiting with read deadlines
+// rather than timers, so no goroutine is left behind when it ends.
+type transfer struct {
+	con  *transferConn
+	opts *xferOptions
+	buf  []byte
+
+	rtt *rtt.Estimator
+
+	// sent holds the packets retransmitted on timeout
+	sent     [][]byte
+	deadline time.Time
+	retries  int
+}
+
+func newTransfer(con *transferConn, opts *xferOptions) *transfer {
+	return &transfer{
+		con:  con,
+		opts: opts,
+		buf:  make([]byte, opts.blksize+4),
+		rtt:  rtt.New(opts.timeout, opts.minTimeout, opts.maxTimeout),
+	}
+}
+
+// send sends the client packets, which are retransmitted until the next
+// call to send or update
+func (t *transfer) send(packets ...pkt.Packet) error {
+	t.sent = t.sent[:0]
+	for _, p := range packets {
+		t.sent = append(t.sent, p.Bytes())
+	}
+	t.retries = 0
+	t.rtt.Sent()
+	return t.transmit()
+}
+
+// update makes p the packet retransmitted on timeout without sending
+// it, and restarts the timer as the client is making progress
+func (t *transfer) update(p pkt.Packet) {
+	t.sent = append(t.sent[:0], p.Bytes())
+	t.retries = 0
+	t.deadline = time.Now().Add(t.rtt.RTO())
+}
+
+// answered tells the transfer that the client answered the packets last
+// sent, timing the round trip
+func (t *transfer) answered() {
+	t.rtt.Answered()
+}
+
+// maxWait is how long recv waits for a quiet client before giving up,
+// from the current retransmit timeout through all of its backoff
+func (t *transfer) maxWait() time.Duration {
+	var wait time.Duration
+	rto := t.rtt.RTO()
+	for i := 0; i <= t.opts.retries; i++ {
+		wait += rto
+		rto *= 2
+		if rto > t.opts.maxTimeout {
+			rto = t.opts.maxTimeout
+		}
+	}
+	return wait
+}
+
+// transmit sends the packets of the last send again
+func (t *transfer) transmit() error {
+	for _, b := range t.sent {
+		_, err := t.con.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+	t.deadline = time.Now().Add(t.rtt.RTO())
+	return nil
+}
+
+// recv returns the next packet from the client, retransmitting whenever
+// the timeout passes first. It returns ErrTimeout once the retransmits
+// run out, after sending it to the client.
+func (t *transfer) recv() (pkt.Packet, error) {
+	for {
+		t.con.SetReadDeadline(t.deadline)
+		n, err := t.con.Read(t.buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if t.retries >= t.opts.retries {
+				// Let the client know, in case it can still
+				// hear us
+				sendError(t.con, ErrTimeout)
+				return nil, ErrTimeout
+			}
+			t.retries++
+			t.rtt.Retransmitted()
+			log.Println("Retransmit")
+			err = t.transmit()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		p, err := pkt.ParsePacket(t.buf[:n])
+		if err != nil {
+			log.Printf("Got bad packet: %s", err)
+			continue
+		}
+		return p, nil
+	}
+}
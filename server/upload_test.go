@@ -0,0 +1,116 @@
+package server_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pkt "github.com/whyrusleeping/go-tftp/packet"
+	"github.com/whyrusleeping/go-tftp/server"
+)
+
+func TestUploadAbandoned(t *testing.T) {
+	servers := map[string]func(dir string) *server.Server{
+		"FileServer": func(dir string) *server.Server {
+			return server.NewFSServer(server.DirFS(dir))
+		},
+		"FuncHandler": func(dir string) *server.Server {
+			return server.NewServer(dir, nil, func(path string) (io.Writer, error) {
+				return os.Create(path)
+			})
+		},
+	}
+	for name, newServer := range servers {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := newServer(dir)
+			s.RetransmitTime = 20 * time.Millisecond
+			s.Retries = 2
+			saddr, err := net.ResolveUDPAddr("udp", startServer(t, s))
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := newPeer(t)
+
+			client.send(&pkt.ReqPacket{Type: pkt.WRQ, Filename: "partial", Mode: pkt.ModeOctet}, saddr)
+			p, port := client.recv()
+			if ack, ok := p.(*pkt.AckPacket); !ok || ack.GetBlocknum() != 0 {
+				t.Fatalf("expected ACK(0), got %v", p)
+			}
+			client.send(&pkt.DataPacket{BlockNum: 1, Data: make([]byte, 512)}, port)
+			p, _ = client.recv()
+			if ack, ok := p.(*pkt.AckPacket); !ok || ack.GetBlocknum() != 1 {
+				t.Fatalf("expected ACK(1), got %v", p)
+			}
+
+			// A block from the future is answered with the last ACK, so the
+			// client resends from there
+			client.send(&pkt.DataPacket{BlockNum: 5, Data: make([]byte, 512)}, port)
+			p, _ = client.recv()
+			if ack, ok := p.(*pkt.AckPacket); !ok || ack.GetBlocknum() != 1 {
+				t.Fatalf("expected ACK(1) again, got %v", p)
+			}
+
+			// Then the client vanishes. The ACK is resent until the server
+			// gives up and says so.
+			var acks int
+			for {
+				p, _ = client.recv()
+				if ack, ok := p.(*pkt.AckPacket); ok && ack.GetBlocknum() == 1 {
+					acks++
+					continue
+				}
+				if errp, ok := p.(*pkt.ErrorPacket); !ok || errp.Value != server.ErrTimeout.Error() {
+					t.Fatalf("expected timeout error, got %v", p)
+				}
+				break
+			}
+			if acks != 2 {
+				t.Fatalf("ACK(1) resent %d times, expected 2", acks)
+			}
+
+			waitStats(t, s, func(st server.Stats) bool { return st.Running == 0 })
+			_, err = os.Stat(filepath.Join(dir, "partial"))
+			if !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("partial upload left behind: %v", err)
+			}
+		})
+	}
+}
+
+func TestUploadFinalAck(t *testing.T) {
+	dir := t.TempDir()
+	s := server.NewFSServer(server.DirFS(dir))
+	saddr, err := net.ResolveUDPAddr("udp", startServer(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newPeer(t)
+
+	client.send(&pkt.ReqPacket{Type: pkt.WRQ, Filename: "short", Mode: pkt.ModeOctet}, saddr)
+	_, port := client.recv()
+
+	// The final ACK is lost, so the last block is retransmitted and
+	// acknowledged again
+	data := []byte("short upload")
+	for i := 0; i < 3; i++ {
+		client.send(&pkt.DataPacket{BlockNum: 1, Data: data}, port)
+		p, from := client.recv()
+		if ack, ok := p.(*pkt.AckPacket); !ok || ack.GetBlocknum() != 1 || from.String() != port.String() {
+			t.Fatalf("expected ACK(1) from %s, got %v from %s", port, p, from)
+		}
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "short"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("uploaded %q, expected %q", got, data)
+	}
+}
@@ -0,0 +1,131 @@
+package server_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	pkt "github.com/whyrusleeping/go-tftp/packet"
+	"github.com/whyrusleeping/go-tftp/server"
+)
+
+// expectBlocks checks that the next packets p receives are the given
+// DATA blocks of data, split into blocks of blksize
+func (p *udpPeer) expectBlocks(data []byte, blksize int, blocks ...uint16) {
+	p.t.Helper()
+	for _, blk := range blocks {
+		reply, _ := p.recv()
+		d, ok := reply.(*pkt.DataPacket)
+		if !ok || d.BlockNum != blk {
+			p.t.Fatalf("expected DATA(%d), got %v", blk, reply)
+		}
+		off := int(blk-1) * blksize
+		end := off + blksize
+		if end > len(data) {
+			end = len(data)
+		}
+		if !bytes.Equal(d.Data, data[off:end]) {
+			p.t.Fatalf("DATA(%d) has %q, want %q", blk, d.Data, data[off:end])
+		}
+	}
+}
+
+// expectAck checks that the next packet p receives is ACK(blk)
+func (p *udpPeer) expectAck(blk uint16) {
+	p.t.Helper()
+	reply, _ := p.recv()
+	if !bytes.Equal(reply.Bytes(), pkt.NewAck(blk).Bytes()) {
+		p.t.Fatalf("expected ACK(%d), got %v", blk, reply)
+	}
+}
+
+// windowRequest is a request for windows of 4 blocks of 8 bytes
+func windowRequest(typ uint16) *pkt.ReqPacket {
+	req := &pkt.ReqPacket{Type: typ, Filename: "file", Mode: pkt.ModeOctet}
+	req.Options.Set(pkt.OptBlockSize, "8")
+	req.Options.Set(pkt.OptWindowSize, "4")
+	return req
+}
+
+func TestWindowRewind(t *testing.T) {
+	data := []byte("0123456701234567012345670123456701234567012345670123456701234567012345670123456701")
+	s := &server.Server{
+		Handler: server.HandlerFunc(func(w server.ResponseWriter, r *server.Request) {
+			w.Write(data)
+		}),
+		// Nothing is sent again but what the test asks for
+		Config: server.Config{RetransmitTime: 5 * time.Second},
+	}
+	peer, saddr := startPeer(t, s)
+
+	oack, reply, port := peer.request(windowRequest(pkt.RRQ), saddr)
+	if oack == nil {
+		t.Fatalf("expected OACK, got %v", reply)
+	}
+	if v, _ := oack.Options.Get(pkt.OptWindowSize); v != "4" {
+		t.Fatalf("OACK windowsize %q", v)
+	}
+	peer.send(pkt.NewAck(0), port)
+	peer.expectBlocks(data, 8, 1, 2, 3, 4)
+
+	// Blocks 3 and 4 were lost, the next window starts after the
+	// block acknowledged (rfc 7440)
+	peer.send(pkt.NewAck(2), port)
+	peer.expectBlocks(data, 8, 3, 4, 5, 6)
+	peer.send(pkt.NewAck(6), port)
+	peer.expectBlocks(data, 8, 7, 8, 9, 10)
+	peer.send(pkt.NewAck(10), port)
+	peer.expectBlocks(data, 8, 11)
+	peer.send(pkt.NewAck(11), port)
+}
+
+func TestWindowedUpload(t *testing.T) {
+	uploads := make(chan []byte, 1)
+	s := &server.Server{
+		Handler: server.HandlerFunc(func(w server.ResponseWriter, r *server.Request) {
+			b, _ := io.ReadAll(r.Body)
+			uploads <- b
+		}),
+		Config: server.Config{RetransmitTime: 5 * time.Second},
+	}
+	peer, saddr := startPeer(t, s)
+
+	oack, reply, port := peer.request(windowRequest(pkt.WRQ), saddr)
+	if oack == nil {
+		t.Fatalf("expected OACK, got %v", reply)
+	}
+	if v, _ := oack.Options.Get(pkt.OptWindowSize); v != "4" {
+		t.Fatalf("OACK windowsize %q", v)
+	}
+	block := func(n uint16, data string) *pkt.DataPacket {
+		return &pkt.DataPacket{BlockNum: n, Data: []byte(data)}
+	}
+
+	// Only the last block of a window is acknowledged
+	for n := uint16(1); n <= 4; n++ {
+		peer.send(block(n, "abcdefgh"), port)
+	}
+	peer.expectAck(4)
+
+	// A gap is acknowledged right away, from the last block in order
+	peer.send(block(5, "ijklmnop"), port)
+	peer.send(block(7, "lost one"), port)
+	peer.expectAck(5)
+
+	// The window starts over from there
+	peer.send(block(6, "qrstuvwx"), port)
+	peer.send(block(7, "yzABCDEF"), port)
+	peer.send(block(8, "GHIJKLMN"), port)
+	peer.send(block(9, "OPQRSTUV"), port)
+	peer.expectAck(9)
+
+	// And the final short block ends the upload in any position
+	peer.send(block(10, "WXYZ"), port)
+	peer.expectAck(10)
+
+	want := "abcdefghabcdefghabcdefghabcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	if b := <-uploads; string(b) != want {
+		t.Fatalf("server got %q", b)
+	}
+}
@@ -1,9 +1,11 @@
 package server
 
 import (
-	"errors"
+	"context"
+	"io"
 	"log"
 	"net"
+	"time"
 
 	pkt "github.com/whyrusleeping/go-tftp/packet"
 )
@@ -11,19 +13,28 @@ import (
 // HandleWriteRequest makes a UDP connection back to the client
 // and completes a TFTP Write request with them
 func (s *Server) HandleWriteReq(wrq *pkt.ReqPacket, addr *net.UDPAddr) error {
+	return s.handleWriteReq(wrq, addr, nil)
+}
+
+func (s *Server) handleWriteReq(wrq *pkt.ReqPacket, addr *net.UDPAddr, f *flight) error {
 	log.Printf("Write Request: %s", wrq.Filename)
 
-	// 'Our' Address
-	listaddr, err := net.ResolveUDPAddr("udp", ":0")
+	// A new port of ours for the transfer
+	con, err := s.dial(addr)
 	if err != nil {
 		return err
 	}
+	defer con.Close()
+	con.flight = f
 
-	// Connection directly to their open port
-	con, err := net.DialUDP("udp", listaddr, addr)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = s.trackConn(con, cancel)
 	if err != nil {
+		sendError(con, errServerClosing)
 		return err
 	}
+	defer s.untrackConn(con)
 
 	if s.ReadOnly {
 		errPkt := pkt.ErrorPacket{}
@@ -33,65 +44,185 @@ func (s *Server) HandleWriteReq(wrq *pkt.ReqPacket, addr *net.UDPAddr) error {
 		return err
 	}
 
-	// Lol, security? What security?
-	fi, err := s.WriteFunc(s.servdir + "/" + wrq.Filename)
+	netascii, err := checkMode(wrq, con)
 	if err != nil {
 		return err
 	}
 
-	// Send ACK(0)
-	ackPkt := pkt.NewAck(0)
-	_, err = con.Write(ackPkt.Bytes())
+	opts, oack := s.negotiate(wrq, -1)
+	if s.MaxWriteSize > 0 && opts.tsize > s.MaxWriteSize {
+		return s.sendDiskFull(con)
+	}
+
+	r, err := s.newRequest(ctx, wrq, addr, con)
 	if err != nil {
 		return err
 	}
+	w := newResponse(r)
+	w.start(s.handler())
+
+	err = s.receiveFile(con, w, opts, oack, netascii)
+	if err != nil {
+		cancel()
+		w.abort(err)
+	}
+	<-w.done
+	return err
+}
+
+// receiveFile receives the clients upload, passing it on to the
+// handler behind w
+func (s *Server) receiveFile(con *transferConn, w *response, opts *xferOptions, oack *pkt.OAckPacket, netascii bool) error {
+	// Wait for the handler to either start reading or fail
+	<-w.ready
+	if err := w.error(); err != nil {
+		sendError(con, err)
+		return err
+	}
+
+	var fi io.Writer = w.pw
+	var nw *pkt.NetasciiWriter
+	if netascii {
+		nw = pkt.NewNetasciiWriter(fi)
+		fi = nw
+	}
 
+	// Send ACK(0), or an OACK in its place if options were agreed on
+	var reply pkt.Packet = pkt.NewAck(0)
+	if oack != nil {
+		reply = oack
+	}
+	t := newTransfer(con, opts)
+	err := t.send(reply)
+	if err != nil {
+		return err
+	}
+
+	var written int64
 	curblk := uint16(1)
-	buf := make([]byte, TftpMaxPacketSize)
+	// inwindow counts the blocks received since our last ACK
+	inwindow := 0
 	for {
-		n, _, err := con.ReadFromUDP(buf)
-		if err != nil {
-			return err
-		}
-
-		idata, err := pkt.ParsePacket(buf[:n])
+		// Our last ACK is resent if the client goes quiet, in case
+		// it or part of the window was lost
+		idata, err := t.recv()
 		if err != nil {
 			return err
 		}
 
 		data, ok := idata.(*pkt.DataPacket)
 		if !ok {
-			return ErrUnexpectedPacket
+			switch p := idata.(type) {
+			case *pkt.ErrorPacket:
+				// The client gave up
+				return p
+			case *pkt.ReqPacket:
+				// In single port mode, a retransmit of the request
+				// as our reply was lost
+				err = t.send(reply)
+				if err != nil {
+					return err
+				}
+			default:
+				// Likely a late ACK from an earlier transfer of
+				// the client in single port mode
+				log.Printf("ignoring unexpected packet of type %d", idata.GetType())
+			}
+			continue
 		}
 
-		if data.BlockNum == curblk-1 {
-			// They didnt get our ack... lets send it again
-			ackPkt := pkt.NewAck(curblk - 1)
-			_, err = con.Write(ackPkt.Bytes())
+		if data.BlockNum != curblk {
+			// Either they didnt get our ack, or a block of the window
+			// was lost. Acknowledge the last block we got in order so
+			// they resend from there (rfc 7440)
+			err = t.send(reply)
 			if err != nil {
 				return err
 			}
-
+			inwindow = 0
 			continue
-		} else if data.BlockNum != curblk {
-			return errors.New("Received unexpected blocknum... stopping transfer.")
+		}
+
+		t.answered()
+		written += int64(len(data.Data))
+		if s.MaxWriteSize > 0 && written > s.MaxWriteSize {
+			return s.sendDiskFull(con)
 		}
 
 		_, err = fi.Write(data.Data)
 		if err != nil {
+			// The handler failed, or stopped reading
+			sendError(con, err)
 			return err
 		}
 
-		ackPkt := pkt.NewAck(curblk)
-		_, err = con.Write(ackPkt.Bytes())
-		if err != nil {
-			return err
+		last := len(data.Data) < opts.blksize
+		if last {
+			// The final ACK is only sent once the handler is done
+			// with the file, as it may still fail to save it
+			if nw != nil {
+				nw.Flush()
+			}
+			w.pw.Close()
+			<-w.done
+			if err := w.error(); err != nil {
+				sendError(con, err)
+				return err
+			}
+		}
+
+		// Only the last block of each window is acknowledged
+		reply = pkt.NewAck(curblk)
+		inwindow++
+		if last || inwindow == opts.windowsize {
+			err = t.send(reply)
+			if err != nil {
+				return err
+			}
+			inwindow = 0
+		} else {
+			t.update(reply)
 		}
 
-		if len(data.Data) < 512 {
+		if last {
+			// The upload is complete, a new request for the
+			// file is no retransmit
+			s.endFlight(con.flight)
+			dally(t, reply)
 			return nil
 		}
 
-		curblk++
+		curblk = pkt.NextBlockNum(curblk, opts.rollover)
+	}
+}
+
+// dally answers retransmits of the final block with the final ACK, in
+// case it was lost. The client backs off its retransmits as we do, so
+// it is only assumed to be gone after being quiet for t.maxWait.
+func dally(t *transfer, ack pkt.Packet) {
+	final := ack.(*pkt.AckPacket).GetBlocknum()
+	wait := t.maxWait()
+	for {
+		t.con.SetReadDeadline(time.Now().Add(wait))
+		n, err := t.con.Read(t.buf)
+		if err != nil {
+			return
+		}
+		p, err := pkt.ParsePacket(t.buf[:n])
+		if data, ok := p.(*pkt.DataPacket); ok && err == nil && data.BlockNum == final {
+			t.con.Write(ack.Bytes())
+		}
+	}
+}
+
+// sendDiskFull tells the client their upload is over MaxWriteSize
+func (s *Server) sendDiskFull(con *transferConn) error {
+	errPkt := pkt.ErrorPacket{}
+	errPkt.Value = "file exceeds maximum upload size"
+	errPkt.Code = pkt.TFTPErrDiskFull
+	_, err := con.Write(errPkt.Bytes())
+	if err != nil {
+		return err
 	}
+	return ErrTooLarge
 }
@@ -0,0 +1,128 @@
+package tftptest
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Faults describes the faults a LossyConn injects into the packets
+// written to it. Rates are the probability of each packet being
+// affected, from 0 to 1.
+type Faults struct {
+	// Seed seeds the random choices, the same seed and sequence of
+	// packets gives the same faults
+	Seed int64
+
+	// Loss drops packets
+	Loss float64
+	// Duplicate sends packets twice
+	Duplicate float64
+	// Reorder holds packets back until after the next one is sent
+	Reorder float64
+	// Delay is the longest a packet is delayed by, each packet is
+	// delayed by a random time up to it
+	Delay time.Duration
+	// Truncate cuts packets short
+	Truncate float64
+	// Corrupt flips a random bit of packets
+	Corrupt float64
+}
+
+// reorderHold is the longest a reordered packet is held back waiting
+// for another to overtake it
+const reorderHold = 10 * time.Millisecond
+
+// LossyConn is a net.PacketConn that simulates an unreliable network,
+// injecting faults into the packets written to it. Wrapping both ends
+// of a connection makes it unreliable in both directions.
+type LossyConn struct {
+	net.PacketConn
+	faults Faults
+
+	mu   sync.Mutex
+	rand *rand.Rand
+	held *heldPacket
+}
+
+type heldPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// NewLossyConn returns a LossyConn writing to c.
+func NewLossyConn(c net.PacketConn, faults Faults) *LossyConn {
+	return &LossyConn{
+		PacketConn: c,
+		faults:     faults,
+		rand:       rand.New(rand.NewSource(faults.Seed)),
+	}
+}
+
+// WriteTo sends b to addr, or pretends to. Errors are only returned
+// for packets that were really sent.
+func (c *LossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.chance(c.faults.Loss) {
+		return len(b), nil
+	}
+
+	// b may be reused once we return
+	data := append([]byte(nil), b...)
+	if c.chance(c.faults.Truncate) && len(data) > 0 {
+		data = data[:c.rand.Intn(len(data))]
+	}
+	if c.chance(c.faults.Corrupt) && len(data) > 0 {
+		bit := c.rand.Intn(len(data) * 8)
+		data[bit/8] ^= 1 << (bit % 8)
+	}
+
+	copies := 1
+	if c.chance(c.faults.Duplicate) {
+		copies = 2
+	}
+
+	if c.held == nil && c.chance(c.faults.Reorder) {
+		held := &heldPacket{data, addr}
+		c.held = held
+		time.AfterFunc(reorderHold, func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.held == held {
+				c.held = nil
+				c.send(held.data, held.addr)
+			}
+		})
+		return len(b), nil
+	}
+
+	var err error
+	for i := 0; i < copies; i++ {
+		err = c.send(data, addr)
+	}
+	if c.held != nil {
+		c.send(c.held.data, c.held.addr)
+		c.held = nil
+	}
+	return len(b), err
+}
+
+// send writes data to addr, after a random delay if one is set. It
+// must be called with mu held.
+func (c *LossyConn) send(data []byte, addr net.Addr) error {
+	if c.faults.Delay <= 0 {
+		_, err := c.PacketConn.WriteTo(data, addr)
+		return err
+	}
+	delay := time.Duration(c.rand.Int63n(int64(c.faults.Delay)))
+	time.AfterFunc(delay, func() {
+		c.PacketConn.WriteTo(data, addr)
+	})
+	return nil
+}
+
+func (c *LossyConn) chance(rate float64) bool {
+	return rate > 0 && c.rand.Float64() < rate
+}
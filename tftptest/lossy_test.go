@@ -0,0 +1,233 @@
+package tftptest_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/whyrusleeping/go-tftp/client"
+	pkt "github.com/whyrusleeping/go-tftp/packet"
+	"github.com/whyrusleeping/go-tftp/tftptest"
+)
+
+// heavyLoss is lossy enough for most exchanges to need retransmits,
+// but keeps the content of packets intact
+var heavyLoss = tftptest.Faults{
+	Loss:      0.2,
+	Duplicate: 0.1,
+	Reorder:   0.1,
+	Delay:     2 * time.Millisecond,
+}
+
+const lossyRetries = 50
+
+// startLossy starts a server injecting faults. Under heavy loss both ends
+// need more retransmits than usual before giving up, see lossyRetries.
+func startLossy(t *testing.T, faults tftptest.Faults, singlePort bool) *tftptest.Server {
+	ts := tftptest.NewUnstartedServer(t, nil)
+	ts.Faults = &faults
+	ts.Server.Retries = lossyRetries
+	ts.Server.SinglePort = singlePort
+	ts.Start()
+	return ts
+}
+
+func TestLossyConn(t *testing.T) {
+	data := make([]byte, 20000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	for i, mode := range []string{pkt.ModeOctet, pkt.ModeNetascii} {
+		for j, blksize := range []int{512, 1428} {
+			for k, windowsize := range []int{1, 4} {
+				name := fmt.Sprintf("%s/blksize=%d/windowsize=%d", mode, blksize, windowsize)
+				t.Run(name, func(t *testing.T) {
+					faults := heavyLoss
+					faults.Seed = int64(i*100 + j*10 + k)
+					ts := startLossy(t, faults, false)
+					ts.SetFile("file", data)
+
+					cli := ts.Client()
+					cli.Mode = mode
+					cli.Blocksize = blksize
+					cli.WindowSize = windowsize
+					cli.Timeout = 20 * time.Millisecond
+					cli.Retries = lossyRetries
+
+					out := new(bytes.Buffer)
+					_, err := cli.GetFile("file", out)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(out.Bytes(), data) {
+						t.Fatal("downloaded data mismatch")
+					}
+
+					_, err = cli.PutFile("upload", bytes.NewReader(data))
+					if err != nil {
+						t.Fatal(err)
+					}
+					got, _ := ts.File("upload")
+					if !bytes.Equal(got, data) {
+						t.Fatalf("uploaded data mismatch, got %d bytes", len(got))
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestLossySinglePort(t *testing.T) {
+	data := make([]byte, 20000)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	for i, mode := range []string{pkt.ModeOctet, pkt.ModeNetascii} {
+		t.Run(mode, func(t *testing.T) {
+			faults := heavyLoss
+			faults.Seed = int64(1000 + i)
+			ts := startLossy(t, faults, true)
+			ts.SetFile("file", data)
+
+			cli := ts.Client()
+			cli.Mode = mode
+			cli.WindowSize = 4
+			cli.Timeout = 20 * time.Millisecond
+			cli.Retries = lossyRetries
+
+			out := new(bytes.Buffer)
+			_, err := cli.GetFile("file", out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), data) {
+				t.Fatal("downloaded data mismatch")
+			}
+
+			_, err = cli.PutFile("upload", bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := ts.File("upload")
+			if !bytes.Equal(got, data) {
+				t.Fatalf("uploaded data mismatch, got %d bytes", len(got))
+			}
+		})
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	// TFTP has no checksums, so damaged packets can make transfers
+	// fail or even deliver the wrong data. They must still end.
+	data := bytes.Repeat([]byte("corruptible\n"), 1000)
+	faults := tftptest.Faults{
+		Seed:     7,
+		Loss:     0.05,
+		Truncate: 0.05,
+		Corrupt:  0.05,
+	}
+	ts := tftptest.NewLossyServer(t, nil, faults)
+	ts.SetFile("file", data)
+
+	for i := 0; i < 5; i++ {
+		cli := ts.Client()
+		cli.Timeout = 10 * time.Millisecond
+		cli.WindowSize = 4
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			cli.GetFile("file", nil)
+			cli.PutFile("upload", bytes.NewReader(data))
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("transfer %d did not end", i)
+		}
+	}
+}
+
+func TestFaultsDeterministic(t *testing.T) {
+	faults := tftptest.Faults{Seed: 3, Loss: 0.3, Duplicate: 0.3, Truncate: 0.3, Corrupt: 0.3}
+
+	// receive sends numbered packets through a LossyConn, returning
+	// what arrives
+	receive := func() []string {
+		dst, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dst.Close()
+		src, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lossy := tftptest.NewLossyConn(src, faults)
+		defer lossy.Close()
+
+		for i := 0; i < 100; i++ {
+			lossy.WriteTo([]byte(fmt.Sprintf("packet %d", i)), dst.LocalAddr())
+		}
+		var got []string
+		buf := make([]byte, 100)
+		for {
+			dst.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			n, _, err := dst.ReadFrom(buf)
+			if err != nil {
+				return got
+			}
+			got = append(got, string(buf[:n]))
+		}
+	}
+
+	first := receive()
+	if len(first) == 0 || len(first) == 100 {
+		t.Fatalf("%d of 100 packets arrived", len(first))
+	}
+	second := receive()
+	if fmt.Sprint(first) != fmt.Sprint(second) {
+		t.Fatalf("faults differ for the same seed:\n%q\n%q", first, second)
+	}
+}
+
+func TestLossyUpload(t *testing.T) {
+	// Only the packets of the client are lost, as the server sends
+	// the final ACK of an upload just once
+	data := make([]byte, 20000)
+	rand.New(rand.NewSource(3)).Read(data)
+
+	for i, mode := range []string{pkt.ModeOctet, pkt.ModeNetascii} {
+		for j, windowsize := range []int{1, 4} {
+			name := fmt.Sprintf("%s/windowsize=%d", mode, windowsize)
+			t.Run(name, func(t *testing.T) {
+				ts := tftptest.NewServer(t, nil)
+				conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				faults := heavyLoss
+				faults.Seed = int64(2000 + i*10 + j)
+				cli, err := client.NewTftpClientConn(tftptest.NewLossyConn(conn, faults), ts.Addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer cli.Close()
+				cli.Mode = mode
+				cli.WindowSize = windowsize
+				cli.Timeout = 20 * time.Millisecond
+				cli.Retries = lossyRetries
+
+				_, err = cli.PutFile("upload", bytes.NewReader(data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, _ := ts.File("upload")
+				if !bytes.Equal(got, data) {
+					t.Fatalf("uploaded data mismatch, got %d bytes", len(got))
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,221 @@
+// Package tftptest provides a TFTP server running in the test process,
+// in the spirit of net/http/httptest.
+package tftptest
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"net"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/whyrusleeping/go-tftp/client"
+	"github.com/whyrusleeping/go-tftp/server"
+)
+
+// Server is a TFTP server listening on a loopback port, serving the
+// files of a fstest.MapFS. Files uploaded to it are stored in the same
+// MapFS.
+type Server struct {
+	// Addr is the address the server listens on, as host:port
+	Addr string
+
+	// Server is the server being run. Its settings may be changed
+	// before Start is called.
+	Server *server.Server
+
+	// Faults, if set before Start is called, makes all sockets of the
+	// server and those of the clients made by Client inject faults
+	// into the packets they send. Each socket is seeded differently,
+	// starting from Faults.Seed.
+	Faults *Faults
+
+	t     testing.TB
+	fsys  *memFS
+	mu    sync.Mutex
+	reqs  []server.Request
+	conns []*client.TftpClient
+	// seeds counts the sockets given faults
+	seeds int64
+}
+
+// NewServer starts a server for files, which may be nil to start with
+// no files. It is closed, along with the clients made by Client, when
+// the test and its subtests complete.
+func NewServer(t testing.TB, files fstest.MapFS) *Server {
+	t.Helper()
+	s := NewUnstartedServer(t, files)
+	s.Start()
+	return s
+}
+
+// NewLossyServer starts a server like NewServer, with faults injected
+// into all packets sent, see Server.Faults.
+func NewLossyServer(t testing.TB, files fstest.MapFS, faults Faults) *Server {
+	t.Helper()
+	s := NewUnstartedServer(t, files)
+	s.Faults = &faults
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a server like NewServer, but does not
+// start it so that its settings can still be changed. Start it with
+// Start.
+func NewUnstartedServer(t testing.TB, files fstest.MapFS) *Server {
+	if files == nil {
+		files = fstest.MapFS{}
+	}
+
+	s := &Server{
+		t:    t,
+		fsys: &memFS{files: files},
+	}
+	fileServer := server.FileServer(s.fsys)
+	s.Server = &server.Server{
+		Handler: server.HandlerFunc(func(w server.ResponseWriter, r *server.Request) {
+			s.record(r)
+			fileServer.ServeTFTP(w, r)
+		}),
+		ListenTransfer: s.listen,
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Start starts a server returned by NewUnstartedServer.
+func (s *Server) Start() {
+	s.t.Helper()
+	if s.Addr != "" {
+		panic("tftptest: server already started")
+	}
+	l, err := s.listen()
+	if err != nil {
+		s.t.Fatalf("tftptest: listening: %v", err)
+	}
+	s.Addr = l.LocalAddr().String()
+	go s.Server.Serve(l)
+}
+
+// Client returns a new client for the server.
+func (s *Server) Client() *client.TftpClient {
+	s.t.Helper()
+	conn, err := s.listen()
+	if err != nil {
+		s.t.Fatalf("tftptest: making client: %v", err)
+	}
+	cli, err := client.NewTftpClientConn(conn, s.Addr)
+	if err != nil {
+		conn.Close()
+		s.t.Fatalf("tftptest: making client: %v", err)
+	}
+	s.mu.Lock()
+	s.conns = append(s.conns, cli)
+	s.mu.Unlock()
+	return cli
+}
+
+// listen opens a loopback socket, injecting the faults of the server
+func (s *Server) listen() (net.PacketConn, error) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil || s.Faults == nil {
+		return c, err
+	}
+
+	s.mu.Lock()
+	faults := *s.Faults
+	faults.Seed += s.seeds
+	s.seeds++
+	s.mu.Unlock()
+	return NewLossyConn(c, faults), nil
+}
+
+// Close shuts down the server and the clients made by Client.
+func (s *Server) Close() {
+	s.mu.Lock()
+	conns := s.conns
+	s.conns = nil
+	s.mu.Unlock()
+	for _, cli := range conns {
+		cli.Close()
+	}
+	s.Server.Close()
+}
+
+// Requests returns the requests received so far, in order. Their
+// Body is always nil.
+func (s *Server) Requests() []server.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]server.Request(nil), s.reqs...)
+}
+
+func (s *Server) record(r *server.Request) {
+	req := *r
+	req.Body = nil
+	s.mu.Lock()
+	s.reqs = append(s.reqs, req)
+	s.mu.Unlock()
+}
+
+// File returns the content of the named file, reporting whether it
+// exists. It can be used to check uploads.
+func (s *Server) File(name string) ([]byte, bool) {
+	s.fsys.mu.Lock()
+	defer s.fsys.mu.Unlock()
+	f, ok := s.fsys.files[name]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), f.Data...), true
+}
+
+// SetFile adds or replaces a file served by the server.
+func (s *Server) SetFile(name string, data []byte) {
+	s.fsys.mu.Lock()
+	defer s.fsys.mu.Unlock()
+	s.fsys.files[name] = &fstest.MapFile{Data: data, Mode: 0644, ModTime: time.Now()}
+}
+
+// memFS makes a MapFS writable, and safe to use from the transfers of
+// the server running in parallel
+type memFS struct {
+	mu    sync.Mutex
+	files fstest.MapFS
+}
+
+func (m *memFS) Open(name string) (fs.File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.files.Open(name)
+}
+
+func (m *memFS) Create(name string) (io.WriteCloser, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+	return &memFile{fsys: m, name: name}, nil
+}
+
+// memFile is a file being uploaded, which appears in the file system
+// once it is closed. An aborted upload never appears.
+type memFile struct {
+	bytes.Buffer
+	fsys *memFS
+	name string
+}
+
+func (f *memFile) Close() error {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	f.fsys.files[f.name] = &fstest.MapFile{Data: f.Bytes(), Mode: 0644, ModTime: time.Now()}
+	return nil
+}
+
+func (f *memFile) Abort() error {
+	f.Reset()
+	return nil
+}
@@ -0,0 +1,130 @@
+package tftptest_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	pkt "github.com/whyrusleeping/go-tftp/packet"
+	"github.com/whyrusleeping/go-tftp/tftptest"
+)
+
+func TestServer(t *testing.T) {
+	ts := tftptest.NewServer(t, fstest.MapFS{
+		"pxelinux.0": {Data: []byte("boot loader")},
+	})
+	cli := ts.Client()
+
+	out := new(bytes.Buffer)
+	_, err := cli.GetFile("/pxelinux.0", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "boot loader" {
+		t.Fatalf("got %q", out)
+	}
+
+	_, err = cli.PutFile("upload", bytes.NewReader([]byte("uploaded")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, ok := ts.File("upload")
+	if !ok || string(data) != "uploaded" {
+		t.Fatalf("upload stored as %q, %v", data, ok)
+	}
+
+	_, err = cli.GetFile("missing", nil)
+	if !errors.Is(err, pkt.ErrNotFound) {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+
+	reqs := ts.Requests()
+	want := []struct {
+		typ  uint16
+		name string
+	}{
+		{pkt.RRQ, "pxelinux.0"},
+		{pkt.WRQ, "upload"},
+		{pkt.RRQ, "missing"},
+	}
+	if len(reqs) != len(want) {
+		t.Fatalf("recorded %d requests, expected %d", len(reqs), len(want))
+	}
+	for i, r := range reqs {
+		if r.Type != want[i].typ || r.Filename != want[i].name {
+			t.Errorf("request %d was %d %q, expected %d %q", i, r.Type, r.Filename, want[i].typ, want[i].name)
+		}
+	}
+}
+
+func TestSetFile(t *testing.T) {
+	ts := tftptest.NewServer(t, nil)
+	ts.SetFile("dir/file", []byte("data"))
+
+	out := new(bytes.Buffer)
+	_, err := ts.Client().GetFile("dir/file", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "data" {
+		t.Fatalf("got %q", out)
+	}
+}
+
+func TestInterruptedUpload(t *testing.T) {
+	ts := tftptest.NewUnstartedServer(t, nil)
+	ts.Server.Config.RetransmitTime = 10 * time.Millisecond
+	ts.Server.Config.MinTimeout = 10 * time.Millisecond
+	ts.Server.Config.Retries = 1
+	ts.Start()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	saddr, err := net.ResolveUDPAddr("udp", ts.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recv := func() (pkt.Packet, net.Addr) {
+		t.Helper()
+		buf := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := pkt.ParsePacket(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p, from
+	}
+
+	// Send the first block of the upload, then vanish
+	req := &pkt.ReqPacket{Type: pkt.WRQ, Filename: "partial", Mode: pkt.ModeOctet}
+	conn.WriteTo(req.Bytes(), saddr)
+	p, xaddr := recv()
+	if !bytes.Equal(p.Bytes(), pkt.NewAck(0).Bytes()) {
+		t.Fatalf("expected ACK(0), got %v", p)
+	}
+	conn.WriteTo((&pkt.DataPacket{BlockNum: 1, Data: make([]byte, 512)}).Bytes(), xaddr)
+	if p, _ := recv(); !bytes.Equal(p.Bytes(), pkt.NewAck(1).Bytes()) {
+		t.Fatalf("expected ACK(1), got %v", p)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for st := ts.Server.Stats(); st.Running+st.Pending > 0; st = ts.Server.Stats() {
+		if time.Now().After(deadline) {
+			t.Fatal("upload did not time out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if data, ok := ts.File("partial"); ok {
+		t.Fatalf("partial upload stored as %d bytes", len(data))
+	}
+}